@@ -3,24 +3,21 @@ package annotate
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/logtypes"
+	"github.com/logzio/easy-connect-server/api/operations"
+	"github.com/logzio/easy-connect-server/api/state"
+	"github.com/logzio/easy-connect-server/api/watch"
 	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/cache"
 	"net/http"
+	"reflect"
 	"strings"
-	"time"
-)
-
-const (
-	LogTypeAnnotation         = "logz.io/application_type"
-	InstrumentationAnnotation = "logz.io/traces_instrument"
-	ServiceNameAnnotation     = "logz.io/service-name"
 )
 
 // ResourceAnnotateRequest is the JSON body of the POST request
@@ -31,6 +28,7 @@ const (
 // log_type: desired log type
 // container_name: name of the container associated with the request
 // service_name: the desired service name for the application, should delete instrumentation if this filed is empty
+// the fields of Options set how the change is applied
 type ResourceAnnotateRequest struct {
 	Name           string `json:"name"`
 	Namespace      string `json:"namespace"`
@@ -38,283 +36,464 @@ type ResourceAnnotateRequest struct {
 	LogType        string `json:"log_type,omitempty"`
 	ContainerName  string `json:"container_name"`
 	ServiceName    string `json:"service_name,omitempty"`
+	Options
+
+	// scope limits the fields of the custom resource the request waits for, all of them if empty
+	scope string
+	// warnings are reported with the response, e.g. a service name used by other workloads
+	warnings []string
+}
+
+// Options are the fields shared by the requests that change a workload, they set how the change is applied
+// wait_for_rollout: whether to also wait for the workload's pods to roll out and report them
+// auto_rollback: the opt-in policy that reverts the change if the rollout fails, it implies wait_for_rollout
+// wait_for_turn: whether to wait for the operation in progress on the workload to finish instead of failing with a conflict
+// expected: the state of the container the request is based on, the request is refused if the container changed since
+// service_name_conflicts: warn or reject, overrides the configured policy for a service name used by other workloads
+// custom_log_type: accept a log type that isn't in the log type catalog
+type Options struct {
+	WaitForRollout       bool            `json:"wait_for_rollout,omitempty"`
+	AutoRollback         *RollbackPolicy `json:"auto_rollback,omitempty"`
+	WaitForTurn          bool            `json:"wait_for_turn,omitempty"`
+	Expected             *ExpectedState  `json:"expected,omitempty"`
+	ServiceNameConflicts string          `json:"service_name_conflicts,omitempty"`
+	CustomLogType        bool            `json:"custom_log_type,omitempty"`
 }
 
-// ResourceAnnotateResponse is the data structure for the custom resource
-// the response will contain a list of these fields
+// ResourceAnnotateResponse is the state of the container once the custom resource reflected the change
 // name: the name of the custom resource
 // namespace: the namespace of the custom resource
 // controller_kind: the kind of the controller that created the custom resource
-// log_type: the log type of the application that the container belongs to
-// service_name: the updated service name
-
+// log_type: the log type of the application that the container belongs to, as set in the custom resource
+// service_name: the active service name of the container, null if the container can't be instrumented
+// traces_instrumented: whether the workload is instrumented
+// detection_status: the status of the detection process
+// workload: the generation and rollout status of the workload after the update
+// operation_id: the id of the operation recorded for the request
+// rollback: the automatic rollback of the change, omitted if the change wasn't rolled back
+// warnings: what the change was applied despite of, e.g. a service name used by other workloads
 type ResourceAnnotateResponse struct {
-	Name           string  `json:"name"`
-	Namespace      string  `json:"namespace"`
-	ControllerKind string  `json:"controller_kind"`
-	ServiceName    *string `json:"service_name"`
-	ContainerName  string  `json:"container_name"`
-	LogType        *string `json:"log_type"`
+	Name               string          `json:"name"`
+	Namespace          string          `json:"namespace"`
+	ControllerKind     string          `json:"controller_kind"`
+	ServiceName        *string         `json:"service_name"`
+	ContainerName      string          `json:"container_name"`
+	LogType            *string         `json:"log_type"`
+	TracesInstrumented bool            `json:"traces_instrumented"`
+	DetectionStatus    string          `json:"detection_status"`
+	Workload           *WorkloadStatus `json:"workload"`
+	OperationID        string          `json:"operation_id"`
+	Rollback           *Rollback       `json:"rollback,omitempty"`
+	Warnings           []string        `json:"warnings,omitempty"`
+}
+
+// Handler serves the annotate endpoint
+type Handler struct {
+	app      *api.App
+	logTypes *logtypes.Catalog
+}
+
+// NewHandler creates an annotate Handler that uses the app's clients
+func NewHandler(app *api.App) *Handler {
+	return &Handler{app: app, logTypes: logtypes.FromApp(app)}
 }
 
-func UpdateResourceAnnotations(w http.ResponseWriter, r *http.Request) {
-	logger := api.InitLogger()
+// WaitProgress is the details of an error returned while waiting for the custom resource to update or the workload to roll out
+// unmet_conditions: the fields of the custom resource that didn't reach the requested state when the wait was interrupted
+// workload: the rollout status and pods of the workload, if the wait was interrupted during the rollout
+// rollback: the rollback of the change, if the wait was interrupted while rolling back
+type WaitProgress struct {
+	UnmetConditions []Condition     `json:"unmet_conditions"`
+	Workload        *WorkloadStatus `json:"workload,omitempty"`
+	Rollback        *Rollback       `json:"rollback,omitempty"`
+}
+
+// UpdateResourceAnnotations updates the annotations of a workload and waits for its InstrumentedApplication to reflect the change
+func (h *Handler) UpdateResourceAnnotations(w http.ResponseWriter, r *http.Request) {
 	// Decode JSON body
 	var resource ResourceAnnotateRequest
 	err := json.NewDecoder(r.Body).Decode(&resource)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+err.Error()))
 		return
 	}
-
-	// Get the Kubernetes config
-	config, err := api.GetConfig()
-	if err != nil {
-		logger.Error(api.ErrorKubeConfig, err)
-		http.Error(w, api.ErrorKubeConfig, http.StatusInternalServerError)
+	// Validate input before updating resources to avoid changing resources and retuning an error
+	if !h.validate(w, r, resource, stringValue(resource.LogType), stringValue(resource.ServiceName)) ||
+		!h.checkServiceName(w, r, &resource, stringValue(resource.ServiceName)) {
 		return
 	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// choose the instrumentation annotation value and value according to the service name
+	actionValue := api.InstrumentValue
+	if resource.ServiceName == "" {
+		actionValue = api.RollbackValue
+	}
+	h.apply(w, r, resource, operations.Operation{Type: operations.TypeAnnotate}, func(ctx context.Context, isInstrumentble bool) (*podTemplateChange, error) {
+		return updatePodTemplate(ctx, h.app.Clientset, resource, func(template *corev1.PodTemplateSpec, _ int64) error {
+			if template.Annotations == nil {
+				template.Annotations = make(map[string]string)
+			}
+			setAnnotations(template.Annotations, resource, actionValue, isInstrumentble)
+			return nil
+		})
+	})
+}
+
+// updateFunc changes the pod template of the workload of an operation, isInstrumentble tells whether the container can be instrumented
+type updateFunc func(ctx context.Context, isInstrumentble bool) (*podTemplateChange, error)
+
+// apply records an operation, changes the pod template of the workload with update and waits for the InstrumentedApplication
+// to reflect the change. With resource.WaitForRollout or resource.AutoRollback it also waits for the rollout, which is rolled
+// back if it fails the policy. The response or the error is written to w.
+func (h *Handler) apply(w http.ResponseWriter, r *http.Request, resource ResourceAnnotateRequest, record operations.Operation, update updateFunc) {
+	logger := h.app.Logger
+	clientset := h.app.Clientset
+	// Define timeout for the context, the context is also cancelled if the client disconnects
+	ctx, cancel := context.WithTimeout(r.Context(), h.app.RequestTimeout())
+	defer cancel()
+	// Record the operation in the audit trail before changing anything, the operations of a workload run one at a time
+	record.Workload = workloadOf(resource)
+	record.ContainerName = resource.ContainerName
+	record.Actor = r.Header.Get(api.ActorHeader)
+	record.RequestID = api.RequestIDFrom(r.Context())
+	operation, ok := h.startOperation(w, r, ctx, record, resource.WaitForTurn)
+	if !ok {
 		return
 	}
-	// Create a dynamic client
-	dynamicClient, err := dynamic.NewForConfig(config)
+	// a panic must not keep the workload locked, the recovery middleware writes the error
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			h.app.Operations.Finish(operation.ID, operations.StatusFailed, fmt.Errorf("panic: %v", recovered))
+			panic(recovered)
+		}
+	}()
+	// Register for the updates of the InstrumentedApplication before reading it, so no change is missed
+	waiter := h.app.Watches.Register(resource.Namespace, resource.Name)
+	defer waiter.Deregister()
+	customResourceObj, err := h.app.DynamicClient.Resource(api.InstrumentedApplicationGVR).Namespace(resource.Namespace).Get(ctx, resource.Name, v1.GetOptions{})
 	if err != nil {
-		logger.Error(api.ErrorDynamic, zap.Error(err))
-		http.Error(w, api.ErrorDynamic+err.Error(), http.StatusInternalServerError)
+		h.app.Operations.Finish(operation.ID, operations.StatusFailed, err)
+		if api.RequestCancelled(r, logger, "get instrumented application") {
+			return
+		}
+		logger.Error(api.ErrorGet, zap.Error(err))
+		api.WriteError(w, r, api.FromKubernetesError(api.ErrorGet, err))
 		return
 	}
-	// instrumented application crd scheme
-	gvr := schema.GroupVersionResource{
-		Group:    api.ResourceGroup,
-		Version:  api.ResourceVersion,
-		Resource: api.ResourceInstrumentedApplication,
-	}
-	// Validate input before updating resources to avoid changing resources and retuning an error
-	if !isValidResourceAnnotateRequest(resource) {
-		logger.Error(api.ErrorInvalidInput)
-		http.Error(w, api.ErrorInvalidInput, http.StatusBadRequest)
-		return
+	isInstrumentble := isInstrumentable(customResourceObj)
+	// Refuse to overwrite a state the client didn't see
+	if resource.Expected != nil {
+		if mismatches := resource.Expected.mismatches(customResourceObj, resource.ContainerName); len(mismatches) > 0 {
+			conflict := api.NewError(http.StatusConflict, api.CodeConflict, api.ErrorStateChanged+resource.Name).
+				WithDetails(newStateConflict(mismatches, customResourceObj, resource.ContainerName))
+			h.app.Operations.Finish(operation.ID, operations.StatusFailed, conflict)
+			api.WriteError(w, r, conflict)
+			return
+		}
 	}
 
-	// Define timeout for the context
-	ctxDuration, err := api.GetTimeout()
+	// Update workload and custom resources, keeping the annotations they replace for a rollback
+	change, err := update(ctx, isInstrumentble)
 	if err != nil {
-		logger.Error(api.ErrorInvalidInput, err)
-		http.Error(w, api.ErrorInvalidInput+err.Error(), http.StatusInternalServerError)
+		h.app.Operations.Finish(operation.ID, operations.StatusFailed, err)
+		if api.RequestCancelled(r, logger, "update "+resource.ControllerKind) {
+			return
+		}
+		logger.Error(api.ErrorUpdate, err)
+		api.WriteError(w, r, api.FromKubernetesError(api.ErrorUpdate, err))
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), ctxDuration)
-	defer cancel()
-	customResourceObj, err := dynamicClient.Resource(gvr).Namespace(resource.Namespace).Get(ctx, resource.Name, v1.GetOptions{})
+	h.app.Operations.Update(operation.ID, func(op *operations.Operation) {
+		op.PreviousAnnotations, op.Annotations, op.Generation = change.previous, change.annotations, change.generation
+	})
+	// The state the crd converges to once the instrumentor applied the change
+	desired := desiredStateOf(resource, change.annotations, isInstrumentble)
+	// Wait for convergence, timeout or server shutdown, the waiter was registered before the crd was read so it misses no change
+	current, unmet, err := h.waitForConvergence(ctx, waiter, desired, customResourceObj, resource.Name)
 	if err != nil {
-		logger.Error(api.ErrorGet, zap.Error(err))
-		http.Error(w, api.ErrorGet+err.Error(), http.StatusInternalServerError)
+		h.finishWithWaitError(w, r, operation.ID, resource, api.ErrorTimeout, WaitProgress{UnmetConditions: unmet}, err)
 		return
 	}
-	// Calculate how many crd changes are expected due to the current operations
-	expectedChanges := calculateExpectedCrdChanges(resource, customResourceObj)
-	logger.Infof("Expected numbers of changes for %s resource: %d", resource.Name, expectedChanges)
-	// get
-	isInstrumentble := isInstrumentable(customResourceObj)
-	// Create a channel to signal about workload and crd updates
-	specCh := make(chan struct{})
-	statusCh := make(chan struct{})
-	// Create a dynamic factory that watches for changes in the InstrumentedApplication CRD corresponding to the request resource
-	dynamicFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, 1*time.Second, resource.Namespace, func(options *v1.ListOptions) {
-		options.FieldSelector = "metadata.name=" + resource.Name
-	})
-	crdInformer := dynamicFactory.ForResource(gvr)
-	// watch for crd status changes to indicate about instrumentation status change (instrument, rollback) and spec changes to indicate about log type changes
-	crdInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			n := newObj.(*unstructured.Unstructured)
-			o := oldObj.(*unstructured.Unstructured)
-			newSpec := n.Object["spec"].(map[string]interface{})
-			oldSpec := o.Object["spec"].(map[string]interface{})
-			newStatus := n.Object["status"].(map[string]interface{})
-			oldStatus := o.Object["status"].(map[string]interface{})
-			// spec changes to indicate about log type changes and service name changes
-			if !api.DeepEqualMap(oldSpec, newSpec) {
-				specCh <- struct{}{} // Signal that the update occurred
-			}
-			// status changes to indicate about instrumentation status change
-			if !api.DeepEqualMap(oldStatus, newStatus) {
-				statusCh <- struct{}{}
-			}
-		},
-	})
-	// start watching for changes in crd
-	dynamicFactory.Start(ctx.Done())
 
-	// Create the response
-	response := ResourceAnnotateResponse{
-		Name:           resource.Name,
-		Namespace:      resource.Namespace,
-		ControllerKind: resource.ControllerKind,
-		LogType:        &resource.LogType,
-		ServiceName:    &resource.ServiceName,
-	}
-	response.ContainerName = resource.ContainerName
-	// choose the instrumentation annotation value and value according to the service name
-	actionValue := "true"
-	if resource.ServiceName == "" {
-		actionValue = "rollback"
+	// Report the converged state of the container and the rollout of the updated workload
+	var workload *WorkloadStatus
+	policy := resource.AutoRollback.policy()
+	if resource.WaitForRollout || policy != nil {
+		workload, err = waitForRollout(ctx, clientset, resource, policy, h.app.ShuttingDown(), logger)
+	} else {
+		workload, err = getWorkloadStatus(ctx, clientset, resource.ControllerKind, resource.Namespace, resource.Name)
 	}
-	// Update workload and custom resources
-	switch resource.ControllerKind {
-	case api.KindDeployment:
-		err = handleUpdateDeployment(ctx, resource, clientset, logger, actionValue, isInstrumentble)
-		if err != nil {
+	status := operations.StatusSucceeded
+	var rollback *Rollback
+	var failure *rolloutFailure
+	switch {
+	case errors.As(err, &failure):
+		// Revert the change, the pods of the failed rollout are reported with the rollback
+		logger.Warnw("Rolling back the annotations of an unhealthy rollout", "name", resource.Name, "reason", failure.reason, "operation_id", operation.ID)
+		restored := restoredAnnotations(change.previous, change.annotations)
+		rollback = &Rollback{Reason: failure.reason, Message: failure.message, Annotations: restored}
+		h.app.Operations.Update(operation.ID, func(op *operations.Operation) {
+			op.RollbackReason = failure.reason
+		})
+		// the deadline of the request may have passed, the rollback gets its own timeout and completes if the client disconnects
+		rollbackCtx, cancelRollback := context.WithTimeout(context.Background(), h.app.RequestTimeout())
+		defer cancelRollback()
+		if _, err = restoreAnnotations(rollbackCtx, clientset, resource, restored, nil); err != nil {
+			h.app.Operations.Finish(operation.ID, operations.StatusFailed, err)
+			if api.RequestCancelled(r, logger, "roll back "+resource.ControllerKind) {
+				return
+			}
 			logger.Error(api.ErrorUpdate, err)
-			http.Error(w, api.ErrorUpdate+err.Error(), http.StatusInternalServerError)
+			api.WriteError(w, r, api.FromKubernetesError(api.ErrorUpdate, err))
+			return
 		}
-	case api.KindStatefulSet:
-		err = handleUpdateStatefulset(ctx, resource, clientset, logger, actionValue, isInstrumentble)
+		current, unmet, err = h.waitForConvergence(rollbackCtx, waiter, desiredStateOf(resource, restored, isInstrumentble), current, resource.Name)
 		if err != nil {
-			logger.Error(api.ErrorUpdate, err)
-			http.Error(w, api.ErrorUpdate+err.Error(), http.StatusInternalServerError)
-		}
-	}
-	// Wait for the expected numbers of updates to occur or timeout
-	for changeNum := 0; changeNum < expectedChanges; changeNum++ {
-		select {
-		case <-statusCh:
-			logger.Info("crd status changed: ", resource.Name)
-		case <-specCh:
-			logger.Info("crd spec changed: ", resource.Name)
-		case <-ctx.Done():
-			logger.Error(api.ErrorTimeout + resource.Name)
-			http.Error(w, api.ErrorTimeout+resource.Name, http.StatusInternalServerError)
+			h.finishWithWaitError(w, r, operation.ID, resource, api.ErrorTimeout, WaitProgress{UnmetConditions: unmet, Workload: workload, Rollback: rollback}, err)
 			return
 		}
+		status = operations.StatusRolledBack
+	case err != nil:
+		h.finishWithWaitError(w, r, operation.ID, resource, api.ErrorRollout, WaitProgress{UnmetConditions: []Condition{}, Workload: workload}, err)
+		return
+	}
+	if resource.WaitForRollout || policy != nil {
+		h.reportPods(r.Context(), resource, workload)
 	}
+	h.app.Operations.Finish(operation.ID, status, nil)
+	response := newResourceAnnotateResponse(resource, current, workload)
+	response.OperationID = operation.ID
+	response.Rollback = rollback
+	response.Warnings = resource.warnings
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
 
-func isValidResourceAnnotateRequest(req ResourceAnnotateRequest) bool {
-	for _, validKind := range api.ValidKinds {
-		if req.ControllerKind == strings.ToLower(validKind) {
-			return true
+// retryAfterSeconds is how long clients are asked to wait before retrying a request whose operation didn't start
+const retryAfterSeconds = "5"
+
+// startOperation starts the operation once no other operation runs on its workload. If wait is false or the wait is
+// interrupted, the error is written to w and ok is false.
+func (h *Handler) startOperation(w http.ResponseWriter, r *http.Request, ctx context.Context, record operations.Operation, wait bool) (operations.Operation, bool) {
+	logger := h.app.Logger
+	// stop waiting for the turn when the server shuts down
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-h.app.ShuttingDown():
+			cancel()
+		case <-waitCtx.Done():
 		}
+	}()
+	operation, err := h.app.Operations.StartExclusive(waitCtx, record, wait)
+	if err == nil {
+		return operation, true
 	}
-	return false
+	var inFlight *operations.InFlightError
+	if r.Context().Err() == nil {
+		// nothing ran, a retry may start the operation
+		w.Header().Set(api.RetryAfterHeader, retryAfterSeconds)
+	}
+	switch {
+	case errors.As(err, &inFlight):
+		logger.Infow("Refusing an operation while another one is in progress", "name", record.Workload.Name, "operation_id", inFlight.Operation.ID)
+		api.WriteError(w, r, api.NewError(http.StatusConflict, api.CodeConflict, api.ErrorInProgress+inFlight.Operation.ID).WithDetails(inFlight.Operation))
+	case api.RequestCancelled(r, logger, "wait for the operation in progress"):
+	case errors.Is(err, context.DeadlineExceeded):
+		api.WriteError(w, r, api.NewError(http.StatusGatewayTimeout, api.CodeTimeout, api.ErrorInProgress+"timeout while waiting for it to finish"))
+	default:
+		api.WriteError(w, r, api.NewError(http.StatusServiceUnavailable, api.CodeShuttingDown, api.ErrorShutdown+"the operation didn't start"))
+	}
+	return operations.Operation{}, false
 }
 
-// isInstrumentable checks if the resource is instrumentable
-func isInstrumentable(customResourceObj *unstructured.Unstructured) bool {
-	if customResourceObj.Object["spec"].(map[string]interface{})["languages"] == nil {
-		return false
+// waitForConvergence waits for the crd to converge to the desired state, starting from its last known version.
+// It returns the last version of the crd and the conditions it doesn't meet, with the error that interrupted the wait.
+func (h *Handler) waitForConvergence(ctx context.Context, waiter *watch.Waiter, desired desiredState, crd *unstructured.Unstructured, name string) (*unstructured.Unstructured, []Condition, error) {
+	current := crd
+	unmet := desired.unmetConditions(current)
+	for len(unmet) > 0 {
+		select {
+		case <-waiter.Ready():
+			events := waiter.Events()
+			if len(events) == 0 {
+				continue
+			}
+			current = events[len(events)-1].New
+			unmet = desired.unmetConditions(current)
+			h.app.Logger.Infow("crd changed", "name", name, "unmet_conditions", len(unmet))
+		case <-h.app.ShuttingDown():
+			return current, unmet, errShuttingDown
+		case <-ctx.Done():
+			return current, unmet, ctx.Err()
+		}
 	}
-	return true
+	return current, nil, nil
 }
 
-// handleUpdateDeployment handles update of deployment
-func handleUpdateDeployment(ctx context.Context, resource ResourceAnnotateRequest, clientset kubernetes.Interface, logger zap.SugaredLogger, actionValue string, isInstrumentble bool) error {
-	logger.Info("Updating deployment: ", resource.Name)
-	deployment, err := clientset.AppsV1().Deployments(resource.Namespace).Get(ctx, resource.Name, v1.GetOptions{})
-	if err != nil {
-		logger.Error(api.ErrorGet, err)
-		return err
+// finishWithWaitError records the failure of an operation whose wait was interrupted and writes the error, with how far the operation got.
+// Nothing is written if the client disconnected. timeoutMessage describes what the operation was waiting for.
+func (h *Handler) finishWithWaitError(w http.ResponseWriter, r *http.Request, operationID string, resource ResourceAnnotateRequest, timeoutMessage string, progress WaitProgress, err error) {
+	logger := h.app.Logger
+	h.app.Operations.Finish(operationID, operations.StatusFailed, err)
+	if api.RequestCancelled(r, logger, "wait for "+resource.ControllerKind) {
+		return
 	}
-	// handle log type
-	if deployment.Spec.Template.ObjectMeta.Annotations == nil {
-		deployment.Spec.Template.ObjectMeta.Annotations = make(map[string]string)
+	var apiErr *api.Error
+	switch {
+	case errors.Is(err, errShuttingDown):
+		// the workload itself was already updated
+		apiErr = api.NewError(http.StatusServiceUnavailable, api.CodeShuttingDown, api.ErrorShutdown+resource.Name)
+	case errors.Is(err, context.DeadlineExceeded):
+		apiErr = api.NewError(http.StatusGatewayTimeout, api.CodeTimeout, timeoutMessage+resource.Name)
+	default:
+		logger.Error(api.ErrorGet, zap.Error(err))
+		api.WriteError(w, r, api.FromKubernetesError(api.ErrorGet, err))
+		return
 	}
-	if len(resource.LogType) != 0 {
-		deployment.Spec.Template.ObjectMeta.Annotations[LogTypeAnnotation] = resource.LogType
-	} else {
-		delete(deployment.Spec.Template.ObjectMeta.Annotations, LogTypeAnnotation)
+	if progress.Workload != nil {
+		h.reportPods(r.Context(), resource, progress.Workload)
 	}
-	if isInstrumentble {
-		// handle traces instrumentation annotations
-		// logz.io/instrument
-		deployment.Spec.Template.ObjectMeta.Annotations[InstrumentationAnnotation] = actionValue
-		// service name
-		if len(resource.ServiceName) != 0 {
-			deployment.Spec.Template.ObjectMeta.Annotations[ServiceNameAnnotation] = resource.ServiceName
-		} else {
-			delete(deployment.Spec.Template.ObjectMeta.Annotations, ServiceNameAnnotation)
-		}
+	logger.Warnw(apiErr.Message, "unmet_conditions", progress.UnmetConditions, "workload", progress.Workload, "operation_id", operationID)
+	api.WriteError(w, r, apiErr.WithDetails(progress))
+}
+
+// reportPods adds the pods of the workload to its status unless they were already listed or the status is unknown, they are
+// omitted if they can't be listed
+func (h *Handler) reportPods(ctx context.Context, resource ResourceAnnotateRequest, workload *WorkloadStatus) {
+	if workload == nil || workload.Pods != nil {
+		return
 	}
-	_, err = clientset.AppsV1().Deployments(resource.Namespace).Update(ctx, deployment, v1.UpdateOptions{})
+	pods, err := listPods(ctx, h.app.Clientset, resource.Namespace, workload)
 	if err != nil {
-		logger.Error(api.ErrorUpdate, err)
-		return err
+		h.app.Logger.Warnw("Error listing the pods of the workload", "name", resource.Name, "error", err)
+		return
 	}
-	return nil
+	workload.Pods = pods
 }
 
-// handleUpdateStatefulset handles update of statefulset
-func handleUpdateStatefulset(ctx context.Context, resource ResourceAnnotateRequest, clientset kubernetes.Interface, logger zap.SugaredLogger, actionValue string, isInstrumentble bool) error {
-	logger.Info("Updating statefulset: ", resource.Name)
-	statefulSet, err := clientset.AppsV1().StatefulSets(resource.Namespace).Get(ctx, resource.Name, v1.GetOptions{})
-	if err != nil {
-		logger.Error(api.ErrorGet, err)
-		return err
+// newResourceAnnotateResponse builds the response from the converged custom resource and the workload status
+func newResourceAnnotateResponse(resource ResourceAnnotateRequest, crd *unstructured.Unstructured, workload *WorkloadStatus) ResourceAnnotateResponse {
+	response := ResourceAnnotateResponse{
+		Name:           resource.Name,
+		Namespace:      resource.Namespace,
+		ControllerKind: resource.ControllerKind,
+		ContainerName:  resource.ContainerName,
+		Workload:       workload,
 	}
-	if statefulSet.Spec.Template.ObjectMeta.Annotations == nil {
-		statefulSet.Spec.Template.ObjectMeta.Annotations = make(map[string]string)
+	if data, ok := state.ContainerData(crd, resource.ContainerName); ok {
+		response.ServiceName = data.ServiceName
+		response.LogType = data.LogType
+		response.TracesInstrumented = data.TracesInstrumented
+		response.DetectionStatus = data.DetectionStatus
 	}
+	return response
+}
+
+func isValidResourceAnnotateRequest(req ResourceAnnotateRequest) bool {
+	for _, validKind := range api.ValidKinds {
+		if req.ControllerKind == strings.ToLower(validKind) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInstrumentable checks if the resource is instrumentable
+func isInstrumentable(customResourceObj *unstructured.Unstructured) bool {
+	return fieldOf(customResourceObj, "spec")["languages"] != nil
+}
+
+// podTemplateChange is a change of the logz.io annotations of a workload's pod template
+// previous: the logz.io annotations before the change
+// annotations: the logz.io annotations after the change
+// generation: the generation of the workload after the change
+type podTemplateChange struct {
+	previous    map[string]string
+	annotations map[string]string
+	generation  int64
+}
+
+// setAnnotations sets the log type and traces instrumentation annotations of a pod template according to the request
+func setAnnotations(annotations map[string]string, resource ResourceAnnotateRequest, actionValue string, isInstrumentble bool) {
 	// handle logs
 	if len(resource.LogType) != 0 {
-		statefulSet.Spec.Template.ObjectMeta.Annotations[LogTypeAnnotation] = resource.LogType
+		annotations[api.LogTypeAnnotation] = resource.LogType
 	} else {
-		delete(statefulSet.Spec.Template.ObjectMeta.Annotations, LogTypeAnnotation)
+		delete(annotations, api.LogTypeAnnotation)
 	}
 	if isInstrumentble {
 		// handle traces instrumentation annotations
 		// logz.io/instrument
-		statefulSet.Spec.Template.ObjectMeta.Annotations[InstrumentationAnnotation] = actionValue
+		annotations[api.InstrumentationAnnotation] = actionValue
 		// service name
 		if len(resource.ServiceName) != 0 {
-			statefulSet.Spec.Template.ObjectMeta.Annotations[ServiceNameAnnotation] = resource.ServiceName
+			annotations[api.ServiceNameAnnotation] = resource.ServiceName
 		} else {
-			delete(statefulSet.Spec.Template.ObjectMeta.Annotations, ServiceNameAnnotation)
+			delete(annotations, api.ServiceNameAnnotation)
 		}
 	}
-	_, err = clientset.AppsV1().StatefulSets(resource.Namespace).Update(ctx, statefulSet, v1.UpdateOptions{})
-	if err != nil {
-		logger.Error(api.ErrorUpdate, err)
-		return err
-	}
-	return nil
 }
 
-// calculateExpectedCrdChanges compares log type and service name of the current request and the existing crd, and return the number of expected crd changes
-func calculateExpectedCrdChanges(resource ResourceAnnotateRequest, crd *unstructured.Unstructured) int {
-	expected := 0
-	// getting the data
-	spec := crd.Object["spec"].(map[string]interface{})
-	activeLogType := spec["logType"].(string)
-	activeServiceName := ""
-	if spec["languages"] != nil {
-		services := spec["languages"].([]interface{})
-		for _, service := range services {
-			if service.(map[string]interface{})["containerName"].(string) == resource.ContainerName {
-				activeServiceName = service.(map[string]interface{})["activeServiceName"].(string)
+// restoreAnnotations replaces the logz.io annotations of the workload's pod template with previous, see restoredAnnotations.
+// If expected isn't nil, the workload must still have the annotations and the generation of expected, otherwise a conflict is returned.
+func restoreAnnotations(ctx context.Context, clientset kubernetes.Interface, resource ResourceAnnotateRequest, previous map[string]string, expected *podTemplateChange) (*podTemplateChange, error) {
+	return updatePodTemplate(ctx, clientset, resource, func(template *corev1.PodTemplateSpec, generation int64) error {
+		current := api.LogzioAnnotations(template.Annotations)
+		if expected != nil && (expected.generation != generation || !reflect.DeepEqual(expected.annotations, current)) {
+			return api.NewError(http.StatusConflict, api.CodeConflict, api.ErrorWorkloadChanged+resource.Name).WithDetails(WorkloadChange{
+				ExpectedGeneration:  expected.generation,
+				Generation:          generation,
+				ExpectedAnnotations: expected.annotations,
+				Annotations:         current,
+			})
+		}
+		restored := map[string]string{}
+		for key, value := range template.Annotations {
+			if !strings.HasPrefix(key, api.AnnotationPrefix) {
+				restored[key] = value
 			}
 		}
+		for key, value := range restoredAnnotations(previous, current) {
+			restored[key] = value
+		}
+		template.Annotations = restored
+		return nil
+	})
+}
+
+// updatePodTemplate reads the workload, changes its pod template with mutate and updates it.
+// mutate receives the generation of the workload, the workload isn't updated if it returns an error.
+func updatePodTemplate(ctx context.Context, clientset kubernetes.Interface, resource ResourceAnnotateRequest, mutate func(template *corev1.PodTemplateSpec, generation int64) error) (*podTemplateChange, error) {
+	switch resource.ControllerKind {
+	case api.KindStatefulSet:
+		statefulSet, err := clientset.AppsV1().StatefulSets(resource.Namespace).Get(ctx, resource.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		previous := api.LogzioAnnotations(statefulSet.Spec.Template.Annotations)
+		if err = mutate(&statefulSet.Spec.Template, statefulSet.Generation); err != nil {
+			return nil, err
+		}
+		updated, err := clientset.AppsV1().StatefulSets(resource.Namespace).Update(ctx, statefulSet, v1.UpdateOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return &podTemplateChange{previous: previous, annotations: api.LogzioAnnotations(updated.Spec.Template.Annotations), generation: updated.Generation}, nil
+	default:
+		deployment, err := clientset.AppsV1().Deployments(resource.Namespace).Get(ctx, resource.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		previous := api.LogzioAnnotations(deployment.Spec.Template.Annotations)
+		if err = mutate(&deployment.Spec.Template, deployment.Generation); err != nil {
+			return nil, err
+		}
+		updated, err := clientset.AppsV1().Deployments(resource.Namespace).Update(ctx, deployment, v1.UpdateOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return &podTemplateChange{previous: previous, annotations: api.LogzioAnnotations(updated.Spec.Template.Annotations), generation: updated.Generation}, nil
 	}
-	// comparison
-	if activeLogType != resource.LogType {
-		expected++
-	}
-	// update
-	if activeServiceName != resource.ServiceName {
-		expected++
-	}
-	// if create operation we are also expecting a status change
-	if activeServiceName == "" && resource.ServiceName != "" {
-		expected++
-	}
-	// if delete operation we are also expecting a status change
-	if resource.ServiceName == "" && activeServiceName != "" {
-		expected++
-	}
-	return expected
 }
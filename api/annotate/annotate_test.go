@@ -0,0 +1,524 @@
+package annotate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/config"
+	"github.com/logzio/easy-connect-server/api/operations"
+	"github.com/logzio/easy-connect-server/api/simulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testNamespace = "default"
+
+// newTestApp creates an App backed by fake clients holding the given workloads and custom resources
+func newTestApp(t *testing.T, timeoutSeconds int, objects ...runtime.Object) *api.App {
+	var workloads, crds []runtime.Object
+	for _, obj := range objects {
+		if _, ok := obj.(*unstructured.Unstructured); ok {
+			crds = append(crds, obj)
+		} else {
+			workloads = append(workloads, obj)
+		}
+	}
+	cfg := config.Default()
+	cfg.RequestTimeoutSeconds = timeoutSeconds
+	app := api.NewAppWithClients(cfg, zap.NewNop().Sugar(), simulator.NewClientset(workloads...), simulator.NewDynamicClient(crds...))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	require.NoError(t, app.Start(ctx))
+	return app
+}
+
+// startInstrumentor runs a simulated instrumentor against the app's clients until the test ends
+func startInstrumentor(t *testing.T, app *api.App) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	simulator.NewInstrumentor(app.Clientset, app.DynamicClient, app.Logger, 0).Start(ctx)
+}
+
+func annotate(t *testing.T, app *api.App, request ResourceAnnotateRequest) *httptest.ResponseRecorder {
+	body, err := json.Marshal(request)
+	require.NoError(t, err)
+	recorder := httptest.NewRecorder()
+	NewHandler(app).UpdateResourceAnnotations(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/annotate", bytes.NewReader(body)))
+	return recorder
+}
+
+func getCrd(t *testing.T, app *api.App, name string) *unstructured.Unstructured {
+	crd, err := app.DynamicClient.Resource(api.InstrumentedApplicationGVR).Namespace(testNamespace).Get(context.Background(), name, v1.GetOptions{})
+	require.NoError(t, err)
+	return crd
+}
+
+func TestUpdateResourceAnnotations(t *testing.T) {
+	for _, kind := range []string{api.KindDeployment, api.KindStatefulSet} {
+		t.Run(kind, func(t *testing.T) {
+			var workload runtime.Object = simulator.Deployment(testNamespace, "adservice", "server")
+			ownerKind := "Deployment"
+			if kind == api.KindStatefulSet {
+				workload = simulator.StatefulSet(testNamespace, "adservice", "server")
+				ownerKind = "StatefulSet"
+			}
+			crd := simulator.InstrumentedApplication(testNamespace, "adservice", ownerKind, []interface{}{simulator.Language("server", "java")}, nil)
+			app := newTestApp(t, 5, workload, crd)
+			startInstrumentor(t, app)
+
+			steps := []ResourceAnnotateRequest{
+				{LogType: "java", ServiceName: "ads"},
+				{LogType: "java", ServiceName: "ads-v2"},
+				{LogType: "", ServiceName: "ads-v2"},
+				{LogType: "python", ServiceName: ""},
+			}
+			for i, step := range steps {
+				step.Name, step.Namespace, step.ControllerKind, step.ContainerName = "adservice", testNamespace, kind, "server"
+				recorder := annotate(t, app, step)
+				require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+				var response ResourceAnnotateResponse
+				require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+				assert.Equal(t, step.ServiceName, *response.ServiceName)
+				assert.Equal(t, step.LogType, *response.LogType)
+				assert.Equal(t, step.ServiceName != "", response.TracesInstrumented)
+				assert.Equal(t, simulator.DetectionPhaseCompleted, response.DetectionStatus)
+				require.NotNil(t, response.Workload)
+				assert.Equal(t, int64(i+2), response.Workload.Generation, "every step changes the pod template")
+				assert.Nil(t, response.Workload.Pods, "pods are only reported when waiting for the rollout")
+
+				updated := getCrd(t, app, "adservice")
+				spec := updated.Object["spec"].(map[string]interface{})
+				status := updated.Object["status"].(map[string]interface{})
+				assert.Equal(t, step.LogType, spec["logType"])
+				assert.Equal(t, step.ServiceName, spec["languages"].([]interface{})[0].(map[string]interface{})["activeServiceName"])
+				assert.Equal(t, step.ServiceName != "", status["tracesInstrumented"])
+				assert.Zero(t, app.Watches.Waiters(), "the request should deregister its waiter")
+			}
+		})
+	}
+}
+
+func TestUpdateResourceAnnotationsNotInstrumentable(t *testing.T) {
+	crd := simulator.InstrumentedApplication(testNamespace, "redis-cart", "StatefulSet", nil, []interface{}{simulator.Application("redis", "redis")})
+	app := newTestApp(t, 5, simulator.StatefulSet(testNamespace, "redis-cart", "redis"), crd)
+	startInstrumentor(t, app)
+
+	recorder := annotate(t, app, ResourceAnnotateRequest{Name: "redis-cart", Namespace: testNamespace, ControllerKind: api.KindStatefulSet,
+		ContainerName: "redis", LogType: "redis", ServiceName: "cart"})
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	var response ResourceAnnotateResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "redis", *response.LogType)
+	assert.Nil(t, response.ServiceName, "a container that can't be instrumented has no service name")
+	assert.False(t, response.TracesInstrumented)
+}
+
+func TestUpdateResourceAnnotationsWaitForRollout(t *testing.T) {
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	app := newTestApp(t, 5, simulator.Deployment(testNamespace, "adservice", "server"), crd)
+	startInstrumentor(t, app)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	simulator.NewRolloutController(app.Clientset, app.Logger, 0).Start(ctx)
+
+	recorder := annotate(t, app, ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment,
+		ContainerName: "server", ServiceName: "ads", Options: Options{WaitForRollout: true}})
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	var response ResourceAnnotateResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	workload := response.Workload
+	require.NotNil(t, workload)
+	assert.True(t, workload.RolloutComplete)
+	assert.Equal(t, workload.Generation, workload.ObservedGeneration)
+	require.NotNil(t, workload.Pods)
+	require.Len(t, workload.Pods.Ready, 1)
+	assert.Equal(t, "adservice-2-0", workload.Pods.Ready[0].Name, "the pod of the updated pod template")
+	assert.Empty(t, workload.Pods.Unready)
+}
+
+func TestUpdateResourceAnnotationsRolloutTimeout(t *testing.T) {
+	deployment := simulator.Deployment(testNamespace, "adservice", "server")
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	// no rollout controller is running, the only pod is crash looping
+	pod := simulator.Pod(testNamespace, "adservice-1-0", deployment.Spec.Template)
+	pod.Status.Conditions[0].Status = corev1.ConditionFalse
+	pod.Status.ContainerStatuses[0] = corev1.ContainerStatus{
+		Name:                 "server",
+		RestartCount:         3,
+		State:                corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+		LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Error", ExitCode: 1}},
+	}
+	app := newTestApp(t, 1, deployment, pod, crd)
+	startInstrumentor(t, app)
+
+	recorder := annotate(t, app, ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment,
+		ContainerName: "server", ServiceName: "ads", Options: Options{WaitForRollout: true}})
+	require.Equal(t, http.StatusGatewayTimeout, recorder.Code, recorder.Body.String())
+
+	var apiErr struct {
+		Code    string       `json:"code"`
+		Message string       `json:"error"`
+		Details WaitProgress `json:"details"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &apiErr))
+	assert.Equal(t, api.CodeTimeout, apiErr.Code)
+	assert.Contains(t, apiErr.Message, api.ErrorRollout)
+	assert.Empty(t, apiErr.Details.UnmetConditions, "the custom resource converged")
+	workload := apiErr.Details.Workload
+	require.NotNil(t, workload)
+	assert.False(t, workload.RolloutComplete)
+	require.NotNil(t, workload.Pods)
+	assert.Empty(t, workload.Pods.Ready)
+	require.Len(t, workload.Pods.Unready, 1)
+	container := workload.Pods.Unready[0].Containers[0]
+	assert.Equal(t, "CrashLoopBackOff", container.Reason)
+	assert.Equal(t, "Error", container.LastTerminationReason)
+	assert.Equal(t, int32(3), container.RestartCount)
+}
+
+func TestUpdateResourceAnnotationsAutoRollback(t *testing.T) {
+	deployment := simulator.Deployment(testNamespace, "adservice", "server")
+	deployment.Annotations = map[string]string{simulator.CrashWhenInstrumentedAnnotation: "true"}
+	deployment.Spec.Template.Annotations = map[string]string{api.LogTypeAnnotation: "java", "prometheus.io/scrape": "true"}
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	app := newTestApp(t, 10, deployment, crd)
+	startInstrumentor(t, app)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	simulator.NewRolloutController(app.Clientset, app.Logger, 0).Start(ctx)
+
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/annotate", bytes.NewReader([]byte(`{"name": "adservice", "namespace": "default",
+		"controller_kind": "deployment", "container_name": "server", "log_type": "java", "service_name": "ads", "auto_rollback": {"enabled": true}}`)))
+	request.Header.Set(api.ActorHeader, "jane@example.com")
+	recorder := httptest.NewRecorder()
+	NewHandler(app).UpdateResourceAnnotations(recorder, request)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	var response ResourceAnnotateResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	require.NotNil(t, response.Rollback)
+	assert.Equal(t, ReasonCrashLoopBackOff, response.Rollback.Reason)
+	assert.Equal(t, map[string]string{api.LogTypeAnnotation: "java", api.InstrumentationAnnotation: api.RollbackValue}, response.Rollback.Annotations)
+	assert.False(t, response.TracesInstrumented, "the response reports the state after the rollback")
+	require.NotNil(t, response.Workload.Pods)
+	require.Len(t, response.Workload.Pods.Unready, 1, "the pods of the failed rollout are reported")
+	assert.True(t, response.Workload.Pods.Unready[0].Updated)
+	assert.Equal(t, "container server of pod "+response.Workload.Pods.Unready[0].Name+" is in CrashLoopBackOff", response.Rollback.Message)
+
+	restored, err := app.Clientset.AppsV1().Deployments(testNamespace).Get(context.Background(), "adservice", v1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{api.LogTypeAnnotation: "java", api.InstrumentationAnnotation: api.RollbackValue, "prometheus.io/scrape": "true"},
+		restored.Spec.Template.Annotations, "the instrumentor removes the agent only for rollback")
+
+	operation, ok := app.Operations.Get(response.OperationID)
+	require.True(t, ok)
+	assert.Equal(t, operations.StatusRolledBack, operation.Status)
+	assert.Equal(t, ReasonCrashLoopBackOff, operation.RollbackReason)
+	assert.Equal(t, "jane@example.com", operation.Actor)
+	assert.Equal(t, map[string]string{api.LogTypeAnnotation: "java"}, operation.PreviousAnnotations)
+	assert.Equal(t, map[string]string{api.LogTypeAnnotation: "java", api.InstrumentationAnnotation: api.InstrumentValue, api.ServiceNameAnnotation: "ads"},
+		operation.Annotations)
+}
+
+func TestUpdateResourceAnnotationsAutoRollbackTimeout(t *testing.T) {
+	// no rollout controller runs, so the rollout of the statefulset never completes
+	statefulSet := simulator.StatefulSet(testNamespace, "adservice", "server")
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "StatefulSet", []interface{}{simulator.Language("server", "java")}, nil)
+	app := newTestApp(t, 1, statefulSet, crd)
+	startInstrumentor(t, app)
+
+	recorder := annotate(t, app, ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindStatefulSet, ContainerName: "server",
+		ServiceName: "ads", Options: Options{AutoRollback: &RollbackPolicy{Enabled: true}}})
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var response ResourceAnnotateResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	require.NotNil(t, response.Rollback)
+	assert.Equal(t, ReasonRolloutTimeout, response.Rollback.Reason)
+	assert.False(t, response.TracesInstrumented, "the rollback converged after the request deadline")
+
+	restored, err := app.Clientset.AppsV1().StatefulSets(testNamespace).Get(context.Background(), "adservice", v1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, api.RollbackValue, restored.Spec.Template.Annotations[api.InstrumentationAnnotation])
+}
+
+func TestCheckRolloutHealth(t *testing.T) {
+	deployment := simulator.Deployment(testNamespace, "adservice", "server")
+	deployment.Spec.Template.Annotations = map[string]string{api.InstrumentationAnnotation: api.InstrumentValue}
+	oldTemplate := deployment.Spec.Template.DeepCopy()
+	oldTemplate.Annotations = nil
+	restarting := simulator.Pod(testNamespace, "adservice-2-0", deployment.Spec.Template)
+	restarting.Status.ContainerStatuses[0].RestartCount = 4
+	testCases := []struct {
+		description string
+		pods        []runtime.Object
+		policy      RollbackPolicy
+		progressing *appsv1.DeploymentCondition
+		reason      string
+	}{
+		{"healthy", []runtime.Object{simulator.Pod(testNamespace, "adservice-2-0", deployment.Spec.Template)}, RollbackPolicy{Enabled: true}, nil, ""},
+		{"crash loop", []runtime.Object{simulator.CrashLoopingPod(simulator.Pod(testNamespace, "adservice-2-0", deployment.Spec.Template))},
+			RollbackPolicy{Enabled: true}, nil, ReasonCrashLoopBackOff},
+		{"old pods are ignored", []runtime.Object{simulator.CrashLoopingPod(simulator.Pod(testNamespace, "adservice-1-0", *oldTemplate))},
+			RollbackPolicy{Enabled: true}, nil, ""},
+		{"restarts below the limit", []runtime.Object{restarting}, RollbackPolicy{Enabled: true, MaxRestarts: 5}, nil, ""},
+		{"too many restarts", []runtime.Object{restarting}, RollbackPolicy{Enabled: true, MaxRestarts: 3}, nil, ReasonTooManyRestarts},
+		{"progress deadline", nil, RollbackPolicy{Enabled: true},
+			&appsv1.DeploymentCondition{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse, Reason: ReasonProgressDeadlineExceeded},
+			ReasonProgressDeadlineExceeded},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			workload := deployment.DeepCopy()
+			if tc.progressing != nil {
+				workload.Status.Conditions = []appsv1.DeploymentCondition{*tc.progressing}
+			}
+			clientset := simulator.NewClientset(tc.pods...)
+			err := checkRolloutHealth(context.Background(), clientset, testNamespace, deploymentStatus(workload), &tc.policy)
+			if tc.reason == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var failure *rolloutFailure
+			require.ErrorAs(t, err, &failure)
+			assert.Equal(t, tc.reason, failure.reason)
+		})
+	}
+}
+
+func TestWorkloadStatus(t *testing.T) {
+	deployment := simulator.Deployment(testNamespace, "adservice", "server")
+	deployment.Generation = 2
+	deployment.Status = appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 1, UpdatedReplicas: 1, ReadyReplicas: 1, AvailableReplicas: 1}
+	assert.False(t, deploymentStatus(deployment).RolloutComplete, "the controller didn't observe the new generation yet")
+
+	deployment.Status = appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 1, ReadyReplicas: 2, AvailableReplicas: 2}
+	assert.False(t, deploymentStatus(deployment).RolloutComplete, "an old pod is still running")
+
+	deployment.Status = appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 1, UpdatedReplicas: 1, ReadyReplicas: 1, AvailableReplicas: 1}
+	assert.True(t, deploymentStatus(deployment).RolloutComplete)
+
+	statefulSet := simulator.StatefulSet(testNamespace, "redis-cart", "redis")
+	statefulSet.Status = appsv1.StatefulSetStatus{ObservedGeneration: 1, Replicas: 1, UpdatedReplicas: 1, ReadyReplicas: 1,
+		CurrentRevision: "redis-cart-1", UpdateRevision: "redis-cart-2"}
+	assert.False(t, statefulSetStatus(statefulSet).RolloutComplete, "the update revision isn't current yet")
+
+	statefulSet.Status.CurrentRevision = "redis-cart-2"
+	assert.True(t, statefulSetStatus(statefulSet).RolloutComplete)
+}
+
+func TestUpdateResourceAnnotationsTimeout(t *testing.T) {
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	// no instrumentor is running, so the custom resource never changes
+	app := newTestApp(t, 1, simulator.Deployment(testNamespace, "adservice", "server"), crd)
+	recorder := annotate(t, app, ResourceAnnotateRequest{
+		Name:           "adservice",
+		Namespace:      testNamespace,
+		ControllerKind: api.KindDeployment,
+		ContainerName:  "server",
+		ServiceName:    "ads",
+	})
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+	var apiErr api.Error
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &apiErr))
+	assert.Equal(t, api.CodeTimeout, apiErr.Code)
+	assert.Contains(t, apiErr.Message, api.ErrorTimeout)
+	assert.Equal(t, map[string]interface{}{"unmet_conditions": []interface{}{
+		map[string]interface{}{"field": "spec.languages[server].activeServiceName", "expected": "ads", "actual": ""},
+		map[string]interface{}{"field": "status.tracesInstrumented", "expected": true, "actual": false},
+	}}, apiErr.Details)
+	assert.Zero(t, app.Watches.Waiters(), "the request should deregister its waiter")
+}
+
+func TestUpdateResourceAnnotationsWithoutSpec(t *testing.T) {
+	// no instrumentor runs and the custom resource has no spec yet, so the request waits for it
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", nil, nil)
+	delete(crd.Object, "spec")
+	app := newTestApp(t, 1, simulator.Deployment(testNamespace, "adservice", "server"), crd)
+
+	recorder := annotate(t, app, ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment, LogType: "java"})
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code, recorder.Body.String())
+}
+
+func TestUpdateResourceAnnotationsInProgress(t *testing.T) {
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	app := newTestApp(t, 10, simulator.Deployment(testNamespace, "adservice", "server"), crd)
+	request := ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment, ContainerName: "server", ServiceName: "ads"}
+	workload := operations.Workload{Namespace: testNamespace, Kind: api.KindDeployment, Name: "adservice"}
+	// no instrumentor is running yet, so the first request waits for the custom resource
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- annotate(t, app, request) }()
+	require.Eventually(t, func() bool { return len(app.Operations.List(workload)) == 1 }, 5*time.Second, 10*time.Millisecond)
+	inFlight := app.Operations.List(workload)[0]
+
+	request.ServiceName = "ads-v2"
+	recorder := annotate(t, app, request)
+	require.Equal(t, http.StatusConflict, recorder.Code, recorder.Body.String())
+	var apiErr struct {
+		Message string               `json:"error"`
+		Code    string               `json:"code"`
+		Details operations.Operation `json:"details"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &apiErr))
+	assert.Equal(t, api.CodeConflict, apiErr.Code)
+	assert.Equal(t, api.ErrorInProgress+inFlight.ID, apiErr.Message)
+	assert.Equal(t, inFlight.ID, apiErr.Details.ID)
+	assert.Equal(t, operations.StatusRunning, apiErr.Details.Status)
+	assert.Equal(t, retryAfterSeconds, recorder.Header().Get(api.RetryAfterHeader), "the request can be retried once the operation finished")
+
+	// a request that waits for its turn runs once the first one finished
+	request.WaitForTurn = true
+	second := make(chan *httptest.ResponseRecorder)
+	go func() { second <- annotate(t, app, request) }()
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, app.Operations.List(workload), 1, "the second request must not start while the first one runs")
+	startInstrumentor(t, app)
+	recorder = <-first
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	recorder = <-second
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var response ResourceAnnotateResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "ads-v2", *response.ServiceName)
+	ops := app.Operations.List(workload)
+	require.Len(t, ops, 2)
+	assert.False(t, ops[1].StartedAt.Before(*ops[0].FinishedAt))
+}
+
+func TestUpdateResourceAnnotationsExpectedState(t *testing.T) {
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	app := newTestApp(t, 5, simulator.Deployment(testNamespace, "adservice", "server"), crd)
+	startInstrumentor(t, app)
+	request := ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment, ContainerName: "server", ServiceName: "ads"}
+	empty, instrumented := "", false
+	request.Expected = &ExpectedState{ResourceVersion: getCrd(t, app, "adservice").GetResourceVersion(), ServiceName: &empty, TracesInstrumented: &instrumented}
+	recorder := annotate(t, app, request)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	// the request is based on the state before the first change
+	request.ServiceName = "ads-v2"
+	recorder = annotate(t, app, request)
+	require.Equal(t, http.StatusConflict, recorder.Code, recorder.Body.String())
+	var apiErr struct {
+		Message string        `json:"error"`
+		Details StateConflict `json:"details"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &apiErr))
+	assert.Equal(t, api.ErrorStateChanged+"adservice", apiErr.Message)
+	current := getCrd(t, app, "adservice")
+	assert.Equal(t, []Condition{
+		{Field: "metadata.resourceVersion", Expected: request.Expected.ResourceVersion, Actual: current.GetResourceVersion()},
+		{Field: "spec.languages[server].activeServiceName", Expected: "", Actual: "ads"},
+		{Field: "status.tracesInstrumented", Expected: false, Actual: true},
+	}, apiErr.Details.Mismatches)
+	require.NotNil(t, apiErr.Details.State)
+	assert.Equal(t, "ads", *apiErr.Details.State.ServiceName)
+	assert.Equal(t, current.GetResourceVersion(), apiErr.Details.State.ResourceVersion)
+
+	deployment, err := app.Clientset.AppsV1().Deployments(testNamespace).Get(context.Background(), "adservice", v1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "ads", deployment.Spec.Template.Annotations[api.ServiceNameAnnotation], "the conflicting request must not change the workload")
+
+	// the fresh state is accepted
+	serviceName, instrumented := "ads", true
+	request.Expected = &ExpectedState{ResourceVersion: current.GetResourceVersion(), ServiceName: &serviceName, TracesInstrumented: &instrumented}
+	recorder = annotate(t, app, request)
+	assert.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+}
+
+func TestUpdateResourceAnnotationsNotFound(t *testing.T) {
+	app := newTestApp(t, 1)
+	recorder := annotate(t, app, ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment})
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"code":"`+api.CodeNotFound+`"`)
+}
+
+func TestUpdateResourceAnnotationsClientDisconnect(t *testing.T) {
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	// no instrumentor is running, so the request waits until the client disconnects
+	app := newTestApp(t, 30, simulator.Deployment(testNamespace, "adservice", "server"), crd)
+	body, err := json.Marshal(ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment, ContainerName: "server", ServiceName: "ads"})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/annotate", bytes.NewReader(body)).WithContext(ctx)
+	cancelled := api.MetricValue(api.MetricCancelledRequests)
+
+	done := make(chan struct{})
+	go func() {
+		NewHandler(app).UpdateResourceAnnotations(httptest.NewRecorder(), request)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler kept waiting after the client disconnected")
+	}
+	assert.Equal(t, cancelled+1, api.MetricValue(api.MetricCancelledRequests))
+	assert.Zero(t, app.Watches.Waiters(), "the request should deregister its waiter")
+}
+
+func TestUpdateResourceAnnotationsInvalidKind(t *testing.T) {
+	app := newTestApp(t, 1)
+	recorder := annotate(t, app, ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: "daemonset"})
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestUnmetConditions(t *testing.T) {
+	crdWith := func(logType, serviceName string, instrumented bool) *unstructured.Unstructured {
+		language := simulator.Language("server", "java")
+		language["activeServiceName"] = serviceName
+		crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{language}, nil)
+		crd.Object["spec"].(map[string]interface{})["logType"] = logType
+		crd.Object["status"].(map[string]interface{})["tracesInstrumented"] = instrumented
+		return crd
+	}
+	testCases := []struct {
+		description    string
+		crd            *unstructured.Unstructured
+		request        ResourceAnnotateRequest
+		instrumentable bool
+		unmetFields    []string
+	}{
+		{"converged", crdWith("java", "ads", true), ResourceAnnotateRequest{LogType: "java", ServiceName: "ads"}, true, nil},
+		{"log type pending", crdWith("java", "ads", true), ResourceAnnotateRequest{LogType: "log", ServiceName: "ads"}, true, []string{"spec.logType"}},
+		{"instrumentation pending", crdWith("", "", false), ResourceAnnotateRequest{ServiceName: "ads"}, true,
+			[]string{"spec.languages[server].activeServiceName", "status.tracesInstrumented"}},
+		{"status pending after spec changed", crdWith("", "ads", false), ResourceAnnotateRequest{ServiceName: "ads"}, true, []string{"status.tracesInstrumented"}},
+		{"rollback pending", crdWith("java", "ads", true), ResourceAnnotateRequest{LogType: "java"}, true,
+			[]string{"spec.languages[server].activeServiceName", "status.tracesInstrumented"}},
+		{"unknown container", crdWith("java", "ads", true), ResourceAnnotateRequest{LogType: "java", ServiceName: "ads", ContainerName: "sidecar"}, true,
+			[]string{"spec.languages[sidecar].activeServiceName"}},
+		{"traces ignored when not instrumentable", crdWith("java", "", false), ResourceAnnotateRequest{LogType: "java", ServiceName: "ads"}, false, nil},
+		{"log type ignored in the traces scope", crdWith("log", "", false), ResourceAnnotateRequest{LogType: "java", ServiceName: "ads", scope: scopeTraces}, true,
+			[]string{"spec.languages[server].activeServiceName", "status.tracesInstrumented"}},
+		{"traces ignored in the logs scope", crdWith("log", "", false), ResourceAnnotateRequest{LogType: "java", ServiceName: "ads", scope: scopeLogs}, true,
+			[]string{"spec.logType"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			if tc.request.ContainerName == "" {
+				tc.request.ContainerName = "server"
+			}
+			var fields []string
+			for _, condition := range newDesiredState(tc.request, tc.instrumentable).unmetConditions(tc.crd) {
+				fields = append(fields, condition.Field)
+			}
+			assert.Equal(t, tc.unmetFields, fields)
+		})
+	}
+}
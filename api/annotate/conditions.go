@@ -0,0 +1,89 @@
+package annotate
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// desiredState is the state an InstrumentedApplication converges to once the instrumentor applied an annotate request
+// log_type: spec.logType equals the requested log type
+// service_name: the activeServiceName of the container's language equals the requested service name, only for instrumentable containers
+// traces_instrumented: status.tracesInstrumented is true if a service name was requested, only for instrumentable containers
+// scope: the fields that are checked, the log type for scopeLogs, the traces fields for scopeTraces and all of them if empty
+type desiredState struct {
+	containerName      string
+	logType            string
+	serviceName        string
+	tracesInstrumented bool
+	instrumentable     bool
+	scope              string
+}
+
+// Scopes of a request that changes only the logs or the traces of a container
+const (
+	scopeLogs   = "logs"
+	scopeTraces = "traces"
+)
+
+// Condition is a field of the InstrumentedApplication that doesn't match the requested state
+// field: the path of the field
+// expected: the requested value
+// actual: the current value, null if the field is missing
+type Condition struct {
+	Field    string      `json:"field"`
+	Expected interface{} `json:"expected"`
+	Actual   interface{} `json:"actual"`
+}
+
+// newDesiredState returns the state the InstrumentedApplication of the requested workload converges to
+func newDesiredState(resource ResourceAnnotateRequest, instrumentable bool) desiredState {
+	return desiredState{
+		containerName:      resource.ContainerName,
+		logType:            resource.LogType,
+		serviceName:        resource.ServiceName,
+		tracesInstrumented: resource.ServiceName != "",
+		instrumentable:     instrumentable,
+		scope:              resource.scope,
+	}
+}
+
+// unmetConditions returns the fields of crd that don't match the desired state yet, none if it converged
+func (d desiredState) unmetConditions(crd *unstructured.Unstructured) []Condition {
+	var unmet []Condition
+	spec := fieldOf(crd, "spec")
+	if logType, _ := spec["logType"].(string); logType != d.logType && d.scope != scopeTraces {
+		unmet = append(unmet, Condition{Field: "spec.logType", Expected: d.logType, Actual: spec["logType"]})
+	}
+	if !d.instrumentable || d.scope == scopeLogs {
+		return unmet
+	}
+	serviceNameField := fmt.Sprintf("spec.languages[%s].activeServiceName", d.containerName)
+	language := findContainer(spec["languages"], d.containerName)
+	if language == nil {
+		unmet = append(unmet, Condition{Field: serviceNameField, Expected: d.serviceName, Actual: nil})
+	} else if serviceName, _ := language["activeServiceName"].(string); serviceName != d.serviceName {
+		unmet = append(unmet, Condition{Field: serviceNameField, Expected: d.serviceName, Actual: language["activeServiceName"]})
+	}
+	status := fieldOf(crd, "status")
+	if instrumented, _ := status["tracesInstrumented"].(bool); instrumented != d.tracesInstrumented {
+		unmet = append(unmet, Condition{Field: "status.tracesInstrumented", Expected: d.tracesInstrumented, Actual: status["tracesInstrumented"]})
+	}
+	return unmet
+}
+
+// findContainer returns the languages or applications entry of a container
+func findContainer(entries interface{}, containerName string) map[string]interface{} {
+	list, _ := entries.([]interface{})
+	for _, entry := range list {
+		if entryMap, ok := entry.(map[string]interface{}); ok && entryMap["containerName"] == containerName {
+			return entryMap
+		}
+	}
+	return nil
+}
+
+// fieldOf returns the spec or status of a custom resource
+func fieldOf(crd *unstructured.Unstructured, field string) map[string]interface{} {
+	value, _ := crd.Object[field].(map[string]interface{})
+	return value
+}
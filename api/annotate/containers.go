@@ -0,0 +1,109 @@
+package annotate
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/logzio/easy-connect-server/api"
+	"net/http"
+	"strings"
+)
+
+// TracesRequest is the JSON body of the PUT traces request
+// service_name: the service name to instrument the container with
+// the fields of Options set how the change is applied
+type TracesRequest struct {
+	ServiceName string `json:"service_name"`
+	Options
+}
+
+// LogsRequest is the JSON body of the PUT logs request
+// log_type: the log type of the application that the container belongs to
+// the fields of Options set how the change is applied
+type LogsRequest struct {
+	LogType string `json:"log_type"`
+	Options
+}
+
+// PutTraces instruments a container with a service name, without changing its log type, and waits for its InstrumentedApplication
+// to reflect the traces fields
+func (h *Handler) PutTraces(w http.ResponseWriter, r *http.Request) {
+	resource := containerResource(r, scopeTraces)
+	var body TracesRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+err.Error()))
+		return
+	}
+	var violations []Violation
+	if body.ServiceName == "" {
+		violations = append(violations, Violation{Field: "service_name", Message: "is required, use DELETE to remove the instrumentation"})
+	}
+	resource.ServiceName, resource.Options = body.ServiceName, body.Options
+	if !h.validate(w, r, resource, nil, stringValue(body.ServiceName), violations...) ||
+		!h.checkServiceName(w, r, &resource, stringValue(body.ServiceName)) {
+		return
+	}
+	h.applyPatch(w, r, resource, ResourcePatchRequest{ServiceName: NullableString{Set: true, Value: &body.ServiceName}})
+}
+
+// DeleteTraces removes the instrumentation of a container, without changing its log type
+func (h *Handler) DeleteTraces(w http.ResponseWriter, r *http.Request) {
+	resource := containerResource(r, scopeTraces)
+	var ok bool
+	if resource.Options, ok = queryOptions(w, r); !ok || !h.validate(w, r, resource, nil, nil) {
+		return
+	}
+	h.applyPatch(w, r, resource, ResourcePatchRequest{ServiceName: NullableString{Set: true}})
+}
+
+// PutLogs sets the log type of a container, without changing its instrumentation, and waits for its InstrumentedApplication
+// to reflect the log type
+func (h *Handler) PutLogs(w http.ResponseWriter, r *http.Request) {
+	resource := containerResource(r, scopeLogs)
+	var body LogsRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+err.Error()))
+		return
+	}
+	var violations []Violation
+	if body.LogType == "" {
+		violations = append(violations, Violation{Field: "log_type", Message: "is required, use DELETE to remove the log type"})
+	}
+	resource.LogType, resource.Options = body.LogType, body.Options
+	if !h.validate(w, r, resource, stringValue(body.LogType), nil, violations...) {
+		return
+	}
+	h.applyPatch(w, r, resource, ResourcePatchRequest{LogType: NullableString{Set: true, Value: &body.LogType}})
+}
+
+// DeleteLogs removes the log type of a container, without changing its instrumentation
+func (h *Handler) DeleteLogs(w http.ResponseWriter, r *http.Request) {
+	resource := containerResource(r, scopeLogs)
+	var ok bool
+	if resource.Options, ok = queryOptions(w, r); !ok || !h.validate(w, r, resource, nil, nil) {
+		return
+	}
+	h.applyPatch(w, r, resource, ResourcePatchRequest{LogType: NullableString{Set: true}})
+}
+
+// containerResource returns the request for the container in the path of r
+func containerResource(r *http.Request, scope string) ResourceAnnotateRequest {
+	vars := mux.Vars(r)
+	return ResourceAnnotateRequest{
+		Name:           vars["name"],
+		Namespace:      vars["namespace"],
+		ControllerKind: strings.ToLower(vars["kind"]),
+		ContainerName:  vars["container"],
+		scope:          scope,
+	}
+}
+
+// queryOptions reads the wait_for_rollout and wait_for_turn options of a DELETE request from its query parameters
+func queryOptions(w http.ResponseWriter, r *http.Request) (Options, bool) {
+	var options Options
+	var ok bool
+	if options.WaitForRollout, ok = boolParameter(w, r, "wait_for_rollout"); !ok {
+		return options, false
+	}
+	options.WaitForTurn, ok = boolParameter(w, r, "wait_for_turn")
+	return options, ok
+}
@@ -0,0 +1,103 @@
+package annotate
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/simulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// containerRequest sends a request for a container of adservice to handler
+func containerRequest(handler http.HandlerFunc, method, container, concern, query, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, "/api/v1/workloads/default/deployment/adservice/containers/"+container+"/"+concern+query, strings.NewReader(body))
+	handler(recorder, mux.SetURLVars(request, map[string]string{"namespace": testNamespace, "kind": "deployment", "name": "adservice", "container": container}))
+	return recorder
+}
+
+func TestContainerConcerns(t *testing.T) {
+	deployment := simulator.Deployment(testNamespace, "adservice", "server")
+	deployment.Spec.Template.Annotations = map[string]string{api.LogTypeAnnotation: "java"}
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	app := newTestApp(t, 5, deployment, crd)
+	startInstrumentor(t, app)
+	handler := NewHandler(app)
+	templateAnnotations := func() map[string]string {
+		deployment, err := app.Clientset.AppsV1().Deployments(testNamespace).Get(context.Background(), "adservice", v1.GetOptions{})
+		require.NoError(t, err)
+		return api.LogzioAnnotations(deployment.Spec.Template.Annotations)
+	}
+
+	recorder := containerRequest(handler.PutTraces, http.MethodPut, "server", "traces", "", `{"service_name":"ads"}`)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var response ResourceAnnotateResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "ads", *response.ServiceName)
+	assert.True(t, response.TracesInstrumented)
+	assert.Equal(t, map[string]string{api.LogTypeAnnotation: "java", api.InstrumentationAnnotation: api.InstrumentValue, api.ServiceNameAnnotation: "ads"}, templateAnnotations())
+
+	recorder = containerRequest(handler.PutLogs, http.MethodPut, "server", "logs", "", `{"log_type":"nginx"}`)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Equal(t, map[string]string{api.LogTypeAnnotation: "nginx", api.InstrumentationAnnotation: api.InstrumentValue, api.ServiceNameAnnotation: "ads"}, templateAnnotations())
+
+	recorder = containerRequest(handler.DeleteTraces, http.MethodDelete, "server", "traces", "?wait_for_turn=true", "")
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Equal(t, map[string]string{api.LogTypeAnnotation: "nginx", api.InstrumentationAnnotation: api.RollbackValue}, templateAnnotations())
+
+	recorder = containerRequest(handler.DeleteLogs, http.MethodDelete, "server", "logs", "", "")
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Equal(t, map[string]string{api.InstrumentationAnnotation: api.RollbackValue}, templateAnnotations())
+}
+
+func TestPutLogsCustomLogType(t *testing.T) {
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	app := newTestApp(t, 5, simulator.Deployment(testNamespace, "adservice", "server"), crd)
+	startInstrumentor(t, app)
+	handler := NewHandler(app)
+
+	recorder := containerRequest(handler.PutLogs, http.MethodPut, "server", "logs", "", `{"log_type":"locust"}`)
+	require.Equal(t, http.StatusBadRequest, recorder.Code, "locust isn't in the catalog")
+	assert.Contains(t, recorder.Body.String(), "custom_log_type")
+
+	recorder = containerRequest(handler.PutLogs, http.MethodPut, "server", "logs", "", `{"log_type":"locust","custom_log_type":true}`)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var response ResourceAnnotateResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "locust", *response.LogType)
+}
+
+func TestPutLogsWithoutDetectionStatus(t *testing.T) {
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	delete(crd.Object["status"].(map[string]interface{}), "instrumentationDetection")
+	app := newTestApp(t, 5, simulator.Deployment(testNamespace, "adservice", "server"), crd)
+	startInstrumentor(t, app)
+
+	recorder := containerRequest(NewHandler(app).PutLogs, http.MethodPut, "server", "logs", "", `{"log_type":"java"}`)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var response ResourceAnnotateResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "java", *response.LogType)
+	assert.Equal(t, "", response.DetectionStatus)
+}
+
+func TestContainerConcernsInvalid(t *testing.T) {
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", nil, []interface{}{simulator.Application("server", "nginx")})
+	app := newTestApp(t, 1, simulator.Deployment(testNamespace, "adservice", "server"), crd)
+	handler := NewHandler(app)
+
+	recorder := containerRequest(handler.PutTraces, http.MethodPut, "server", "traces", "", `{"service_name":"ads"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code, "the container can't be instrumented")
+	assert.Contains(t, recorder.Body.String(), api.ErrorNotInstrumentable)
+
+	assert.Equal(t, http.StatusBadRequest, containerRequest(handler.PutTraces, http.MethodPut, "server", "traces", "", `{}`).Code)
+	assert.Equal(t, http.StatusBadRequest, containerRequest(handler.PutLogs, http.MethodPut, "server", "logs", "", `{"log_type":""}`).Code)
+	assert.Equal(t, http.StatusBadRequest, containerRequest(handler.DeleteLogs, http.MethodDelete, "server", "logs", "?wait_for_turn=maybe", "").Code)
+}
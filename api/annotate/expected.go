@@ -0,0 +1,64 @@
+package annotate
+
+import (
+	"fmt"
+	"github.com/logzio/easy-connect-server/api/state"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// ExpectedState is the state of the container the client based its request on, e.g. a row of /api/v1/state.
+// The request is refused if the InstrumentedApplication no longer matches it, every field is optional.
+// resource_version: the resourceVersion of the InstrumentedApplication, it changes with every update of the resource
+// log_type: the log type of the application
+// service_name: the active service name of the container, empty if the container isn't instrumented
+// traces_instrumented: whether the workload is instrumented
+type ExpectedState struct {
+	ResourceVersion    string  `json:"resource_version,omitempty"`
+	LogType            *string `json:"log_type,omitempty"`
+	ServiceName        *string `json:"service_name,omitempty"`
+	TracesInstrumented *bool   `json:"traces_instrumented,omitempty"`
+}
+
+// StateConflict is the details of the conflict returned when the InstrumentedApplication no longer matches the expected state
+// mismatches: the fields that don't match the expected state, with the expected and the current value
+// state: the current state of the container, as returned by /api/v1/state
+type StateConflict struct {
+	Mismatches []Condition                       `json:"mismatches"`
+	State      *state.InstrumentdApplicationData `json:"state"`
+}
+
+// mismatches returns the fields of crd that don't match the expected state of the container, none if it matches
+func (e *ExpectedState) mismatches(crd *unstructured.Unstructured, containerName string) []Condition {
+	var mismatches []Condition
+	if e.ResourceVersion != "" && crd.GetResourceVersion() != e.ResourceVersion {
+		mismatches = append(mismatches, Condition{Field: "metadata.resourceVersion", Expected: e.ResourceVersion, Actual: crd.GetResourceVersion()})
+	}
+	spec := fieldOf(crd, "spec")
+	if logType, _ := spec["logType"].(string); e.LogType != nil && logType != *e.LogType {
+		mismatches = append(mismatches, Condition{Field: "spec.logType", Expected: *e.LogType, Actual: spec["logType"]})
+	}
+	if e.ServiceName != nil {
+		var actual interface{}
+		if language := findContainer(spec["languages"], containerName); language != nil {
+			actual = language["activeServiceName"]
+		}
+		// a missing service name is the same as an empty one, like in /api/v1/state
+		if serviceName, _ := actual.(string); serviceName != *e.ServiceName {
+			mismatches = append(mismatches, Condition{Field: fmt.Sprintf("spec.languages[%s].activeServiceName", containerName), Expected: *e.ServiceName, Actual: actual})
+		}
+	}
+	status := fieldOf(crd, "status")
+	if instrumented, _ := status["tracesInstrumented"].(bool); e.TracesInstrumented != nil && instrumented != *e.TracesInstrumented {
+		mismatches = append(mismatches, Condition{Field: "status.tracesInstrumented", Expected: *e.TracesInstrumented, Actual: status["tracesInstrumented"]})
+	}
+	return mismatches
+}
+
+// newStateConflict returns the details of a conflict with the current state of the container
+func newStateConflict(mismatches []Condition, crd *unstructured.Unstructured, containerName string) StateConflict {
+	conflict := StateConflict{Mismatches: mismatches}
+	if current, ok := state.ContainerData(crd, containerName); ok {
+		conflict.State = &current
+	}
+	return conflict
+}
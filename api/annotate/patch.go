@@ -0,0 +1,133 @@
+package annotate
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/operations"
+	corev1 "k8s.io/api/core/v1"
+	"net/http"
+)
+
+// NullableString is a JSON field with three states: omitted (Set is false), null (Value is nil) or a value
+type NullableString struct {
+	Set   bool
+	Value *string
+}
+
+// UnmarshalJSON records that the field is present, json calls it for null values too
+func (n *NullableString) UnmarshalJSON(data []byte) error {
+	n.Set = true
+	if string(data) == "null" {
+		n.Value = nil
+		return nil
+	}
+	return json.Unmarshal(data, &n.Value)
+}
+
+// MarshalJSON writes the value, or null if the field is null or omitted
+func (n NullableString) MarshalJSON() ([]byte, error) {
+	return json.Marshal(n.Value)
+}
+
+// ResourcePatchRequest is the JSON body of the PATCH request. It has the fields of ResourceAnnotateRequest, but log_type and
+// service_name only change the workload if they are present.
+// log_type: the log type to set, null to remove the log type, omitted to keep it
+// service_name: the service name to instrument the container with, null to remove the instrumentation, omitted to keep it
+type ResourcePatchRequest struct {
+	ResourceAnnotateRequest
+	// the fields of the embedded request with the same JSON names are shadowed by these
+	LogType     NullableString `json:"log_type"`
+	ServiceName NullableString `json:"service_name"`
+}
+
+// PatchResourceAnnotations changes the log type or the traces instrumentation of a workload, keeping what the request omits,
+// and waits for its InstrumentedApplication to reflect the change
+func (h *Handler) PatchResourceAnnotations(w http.ResponseWriter, r *http.Request) {
+	var patch ResourcePatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+err.Error()))
+		return
+	}
+	resource := patch.ResourceAnnotateRequest
+	if !h.validate(w, r, resource, nonEmpty(patch.LogType.Value), nonEmpty(patch.ServiceName.Value), patch.violations()...) ||
+		!h.checkServiceName(w, r, &resource, nonEmpty(patch.ServiceName.Value)) {
+		return
+	}
+	// set after the validation, which reports the fields of the body and not the path parameters of the container endpoints
+	resource.scope = patch.scope()
+	h.applyPatch(w, r, resource, patch)
+}
+
+// applyPatch applies the fields present in patch to the workload of resource, see apply. If patch sets the service name, the
+// request is refused if the container can't be instrumented.
+func (h *Handler) applyPatch(w http.ResponseWriter, r *http.Request, resource ResourceAnnotateRequest, patch ResourcePatchRequest) {
+	h.apply(w, r, resource, operations.Operation{Type: operations.TypeAnnotate}, func(ctx context.Context, isInstrumentble bool) (*podTemplateChange, error) {
+		if patch.ServiceName.Set && !isInstrumentble {
+			return nil, api.NewError(http.StatusUnprocessableEntity, api.CodeUnprocessable, api.ErrorNotInstrumentable+resource.ContainerName)
+		}
+		return updatePodTemplate(ctx, h.app.Clientset, resource, func(template *corev1.PodTemplateSpec, _ int64) error {
+			if template.Annotations == nil {
+				template.Annotations = map[string]string{}
+			}
+			patch.setAnnotations(template.Annotations, isInstrumentble)
+			return nil
+		})
+	})
+}
+
+// violations returns the violations of the tri-state fields of the patch, their format is checked like the other requests
+func (p ResourcePatchRequest) violations() []Violation {
+	var violations []Violation
+	if !p.LogType.Set && !p.ServiceName.Set {
+		violations = append(violations, Violation{Field: "log_type", Message: "or service_name must be set"})
+	}
+	if p.LogType.Value != nil && *p.LogType.Value == "" {
+		violations = append(violations, Violation{Field: "log_type", Message: "can't be empty, use null to remove it"})
+	}
+	if p.ServiceName.Value != nil && *p.ServiceName.Value == "" {
+		violations = append(violations, Violation{Field: "service_name", Message: "can't be empty, use null to remove the instrumentation"})
+	}
+	return violations
+}
+
+// scope returns the fields of the custom resource the patch changes: the log type, the traces fields or all of them
+func (p ResourcePatchRequest) scope() string {
+	switch {
+	case p.LogType.Set && !p.ServiceName.Set:
+		return scopeLogs
+	case p.ServiceName.Set && !p.LogType.Set:
+		return scopeTraces
+	default:
+		return ""
+	}
+}
+
+// nonEmpty returns value, nil if it is empty
+func nonEmpty(value *string) *string {
+	if value == nil || *value == "" {
+		return nil
+	}
+	return value
+}
+
+// setAnnotations applies the fields present in the patch to the annotations of a pod template, like setAnnotations does for
+// a ResourceAnnotateRequest. The service name is ignored if the container can't be instrumented.
+func (p ResourcePatchRequest) setAnnotations(annotations map[string]string, isInstrumentble bool) {
+	if p.LogType.Set {
+		if p.LogType.Value != nil {
+			annotations[api.LogTypeAnnotation] = *p.LogType.Value
+		} else {
+			delete(annotations, api.LogTypeAnnotation)
+		}
+	}
+	if p.ServiceName.Set && isInstrumentble {
+		if p.ServiceName.Value != nil {
+			annotations[api.InstrumentationAnnotation] = api.InstrumentValue
+			annotations[api.ServiceNameAnnotation] = *p.ServiceName.Value
+		} else {
+			annotations[api.InstrumentationAnnotation] = api.RollbackValue
+			delete(annotations, api.ServiceNameAnnotation)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package annotate
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/simulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func patch(app *api.App, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	NewHandler(app).PatchResourceAnnotations(recorder, httptest.NewRequest(http.MethodPatch, "/api/v1/annotate", strings.NewReader(body)))
+	return recorder
+}
+
+func TestPatchResourceAnnotations(t *testing.T) {
+	deployment := simulator.Deployment(testNamespace, "adservice", "server")
+	deployment.Spec.Template.Annotations = map[string]string{
+		api.LogTypeAnnotation:         "java",
+		api.InstrumentationAnnotation: api.InstrumentValue,
+		api.ServiceNameAnnotation:     "ads",
+	}
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	app := newTestApp(t, 5, deployment, crd)
+	startInstrumentor(t, app)
+	templateAnnotations := func() map[string]string {
+		deployment, err := app.Clientset.AppsV1().Deployments(testNamespace).Get(context.Background(), "adservice", v1.GetOptions{})
+		require.NoError(t, err)
+		return api.LogzioAnnotations(deployment.Spec.Template.Annotations)
+	}
+	workload := `"name":"adservice","namespace":"default","controller_kind":"deployment","container_name":"server"`
+
+	// changing the log type keeps the instrumentation
+	recorder := patch(app, `{`+workload+`,"log_type":"nginx"}`)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Equal(t, map[string]string{api.LogTypeAnnotation: "nginx", api.InstrumentationAnnotation: api.InstrumentValue, api.ServiceNameAnnotation: "ads"}, templateAnnotations())
+	var response ResourceAnnotateResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "nginx", *response.LogType)
+	assert.Equal(t, "ads", *response.ServiceName)
+	assert.True(t, response.TracesInstrumented)
+
+	// null removes the instrumentation and keeps the log type
+	recorder = patch(app, `{`+workload+`,"service_name":null}`)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Equal(t, map[string]string{api.LogTypeAnnotation: "nginx", api.InstrumentationAnnotation: api.RollbackValue}, templateAnnotations())
+
+	recorder = patch(app, `{`+workload+`,"log_type":null,"service_name":"ads-v2"}`)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Equal(t, map[string]string{api.InstrumentationAnnotation: api.InstrumentValue, api.ServiceNameAnnotation: "ads-v2"}, templateAnnotations())
+}
+
+func TestPatchResourceAnnotationsInvalid(t *testing.T) {
+	app := newTestApp(t, 1)
+	workload := `"name":"adservice","namespace":"default","controller_kind":"deployment","container_name":"server"`
+	for name, body := range map[string]string{
+		"nothing to change":     `{` + workload + `}`,
+		"empty log type":        `{` + workload + `,"log_type":""}`,
+		"empty service name":    `{` + workload + `,"service_name":""}`,
+		"invalid kind":          `{"name":"adservice","namespace":"default","controller_kind":"daemonset","log_type":"java"}`,
+		"service name not text": `{` + workload + `,"service_name":1}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, http.StatusBadRequest, patch(app, body).Code)
+		})
+	}
+}
+
+func TestPatchResourceAnnotationsScope(t *testing.T) {
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", nil, []interface{}{simulator.Application("server", "nginx")})
+	app := newTestApp(t, 5, simulator.Deployment(testNamespace, "adservice", "server"), crd)
+	startInstrumentor(t, app)
+	workload := `"name":"adservice","namespace":"default","controller_kind":"deployment","container_name":"server"`
+
+	// the log type of a container that can't be instrumented can be patched
+	recorder := patch(app, `{`+workload+`,"log_type":"nginx"}`)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	recorder = patch(app, `{`+workload+`,"service_name":"ads"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code, "the container can't be instrumented")
+	recorder = patch(app, `{`+workload+`,"log_type":"nginx","service_name":"ads"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code, "the container can't be instrumented")
+}
+
+func TestResourcePatchRequestScope(t *testing.T) {
+	value := "value"
+	assert.Equal(t, scopeLogs, ResourcePatchRequest{LogType: NullableString{Set: true, Value: &value}}.scope())
+	assert.Equal(t, scopeTraces, ResourcePatchRequest{ServiceName: NullableString{Set: true}}.scope())
+	assert.Equal(t, "", ResourcePatchRequest{LogType: NullableString{Set: true}, ServiceName: NullableString{Set: true, Value: &value}}.scope())
+}
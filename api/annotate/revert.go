@@ -0,0 +1,80 @@
+package annotate
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/operations"
+	"net/http"
+	"strconv"
+)
+
+// WorkloadChange is the details of the conflict returned when a workload changed since the operation being reverted
+// expected_generation, generation: the generation of the workload after the operation and now
+// expected_annotations, annotations: the logz.io annotations of the pod template after the operation and now
+type WorkloadChange struct {
+	ExpectedGeneration  int64             `json:"expected_generation"`
+	Generation          int64             `json:"generation"`
+	ExpectedAnnotations map[string]string `json:"expected_annotations"`
+	Annotations         map[string]string `json:"annotations"`
+}
+
+// RevertOperation restores the logz.io annotations a workload had before an operation, and waits for its InstrumentedApplication
+// to reflect them like an annotate request. The revert is refused if the workload changed since the operation, unless force is set.
+func (h *Handler) RevertOperation(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	operation, ok := h.app.Operations.Get(id)
+	if !ok {
+		api.WriteError(w, r, api.NewError(http.StatusNotFound, api.CodeNotFound, "Operation not found: "+id))
+		return
+	}
+	force, ok := boolParameter(w, r, "force")
+	if !ok {
+		return
+	}
+	waitForTurn, ok := boolParameter(w, r, "wait_for_turn")
+	if !ok {
+		return
+	}
+	switch {
+	case operation.Status == operations.StatusRunning:
+		api.WriteError(w, r, api.NewError(http.StatusConflict, api.CodeConflict, api.ErrorOperation+"it is still running"))
+		return
+	case operation.Status == operations.StatusRolledBack:
+		api.WriteError(w, r, api.NewError(http.StatusConflict, api.CodeConflict, api.ErrorOperation+"it was already rolled back"))
+		return
+	case operation.Annotations == nil:
+		api.WriteError(w, r, api.NewError(http.StatusConflict, api.CodeConflict, api.ErrorOperation+"it didn't change the workload"))
+		return
+	}
+
+	resource := ResourceAnnotateRequest{
+		Name:           operation.Workload.Name,
+		Namespace:      operation.Workload.Namespace,
+		ControllerKind: operation.Workload.Kind,
+		ContainerName:  operation.ContainerName,
+		Options:        Options{WaitForTurn: waitForTurn},
+	}
+	// the workload must still be as the operation left it
+	var expected *podTemplateChange
+	if !force {
+		expected = &podTemplateChange{annotations: operation.Annotations, generation: operation.Generation}
+	}
+	h.apply(w, r, resource, operations.Operation{Type: operations.TypeRevert, RevertOf: operation.ID}, func(ctx context.Context, _ bool) (*podTemplateChange, error) {
+		return restoreAnnotations(ctx, h.app.Clientset, resource, operation.PreviousAnnotations, expected)
+	})
+}
+
+// boolParameter parses an optional boolean query parameter, which defaults to false. An invalid value is written to w as an error.
+func boolParameter(w http.ResponseWriter, r *http.Request, name string) (bool, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, true
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+name+" must be true or false"))
+		return false, false
+	}
+	return parsed, true
+}
@@ -0,0 +1,100 @@
+package annotate
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/operations"
+	"github.com/logzio/easy-connect-server/api/simulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func revert(app *api.App, id, query string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/operations/"+id+"/revert"+query, nil)
+	NewHandler(app).RevertOperation(recorder, mux.SetURLVars(request, map[string]string{"id": id}))
+	return recorder
+}
+
+// annotateOperation annotates adservice and returns the id of the operation
+func annotateOperation(t *testing.T, app *api.App, request ResourceAnnotateRequest) string {
+	request.Name, request.Namespace, request.ControllerKind, request.ContainerName = "adservice", testNamespace, api.KindDeployment, "server"
+	recorder := annotate(t, app, request)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var response ResourceAnnotateResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	return response.OperationID
+}
+
+func newRevertTestApp(t *testing.T) *api.App {
+	deployment := simulator.Deployment(testNamespace, "adservice", "server")
+	deployment.Spec.Template.Annotations = map[string]string{api.LogTypeAnnotation: "java"}
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	app := newTestApp(t, 5, deployment, crd)
+	startInstrumentor(t, app)
+	return app
+}
+
+func TestRevertOperation(t *testing.T) {
+	app := newRevertTestApp(t)
+	id := annotateOperation(t, app, ResourceAnnotateRequest{LogType: "python", ServiceName: "ads"})
+
+	recorder := revert(app, id, "")
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var response ResourceAnnotateResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "java", *response.LogType)
+	assert.Equal(t, "", *response.ServiceName)
+	assert.False(t, response.TracesInstrumented)
+
+	deployment, err := app.Clientset.AppsV1().Deployments(testNamespace).Get(context.Background(), "adservice", v1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{api.LogTypeAnnotation: "java", api.InstrumentationAnnotation: api.RollbackValue}, deployment.Spec.Template.Annotations)
+
+	operation, ok := app.Operations.Get(response.OperationID)
+	require.True(t, ok)
+	assert.Equal(t, operations.TypeRevert, operation.Type)
+	assert.Equal(t, id, operation.RevertOf)
+	assert.Equal(t, operations.StatusSucceeded, operation.Status)
+
+	// the revert changed the workload, so the operation can't be reverted again
+	recorder = revert(app, id, "")
+	assert.Equal(t, http.StatusConflict, recorder.Code, recorder.Body.String())
+}
+
+func TestRevertOperationWorkloadChanged(t *testing.T) {
+	app := newRevertTestApp(t)
+	id := annotateOperation(t, app, ResourceAnnotateRequest{LogType: "python", ServiceName: "ads"})
+	annotateOperation(t, app, ResourceAnnotateRequest{LogType: "python", ServiceName: "ads-v2"})
+
+	recorder := revert(app, id, "")
+	require.Equal(t, http.StatusConflict, recorder.Code, recorder.Body.String())
+	var apiErr struct {
+		Code    string         `json:"code"`
+		Details WorkloadChange `json:"details"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &apiErr))
+	assert.Equal(t, api.CodeConflict, apiErr.Code)
+	assert.Equal(t, "ads", apiErr.Details.ExpectedAnnotations[api.ServiceNameAnnotation])
+	assert.Equal(t, "ads-v2", apiErr.Details.Annotations[api.ServiceNameAnnotation])
+	assert.Greater(t, apiErr.Details.Generation, apiErr.Details.ExpectedGeneration)
+
+	recorder = revert(app, id, "?force=true")
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	deployment, err := app.Clientset.AppsV1().Deployments(testNamespace).Get(context.Background(), "adservice", v1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{api.LogTypeAnnotation: "java", api.InstrumentationAnnotation: api.RollbackValue}, deployment.Spec.Template.Annotations)
+}
+
+func TestRevertOperationNotFound(t *testing.T) {
+	app := newTestApp(t, 1)
+	recorder := revert(app, "unknown", "")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"code":"`+api.CodeNotFound+`"`)
+}
@@ -0,0 +1,117 @@
+package annotate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/logzio/easy-connect-server/api"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Reasons of a failed rollout
+const (
+	ReasonCrashLoopBackOff         = "CrashLoopBackOff"
+	ReasonTooManyRestarts          = "TooManyRestarts"
+	ReasonProgressDeadlineExceeded = "ProgressDeadlineExceeded"
+	ReasonRolloutTimeout           = "RolloutTimeout"
+)
+
+// RollbackPolicy is the opt-in policy that reverts an annotate request when the rollout of the updated pod template fails.
+// The rollout fails if a container of an updated pod is in CrashLoopBackOff, restarts more than max_restarts times,
+// if the deployment exceeds its progress deadline, or if the rollout doesn't complete within the request timeout.
+// enabled: whether the change is rolled back when the rollout fails
+// max_restarts: the restarts of a container of an updated pod that fail the rollout, 0 to only fail on CrashLoopBackOff
+type RollbackPolicy struct {
+	Enabled     bool  `json:"enabled"`
+	MaxRestarts int32 `json:"max_restarts,omitempty"`
+}
+
+// Rollback is the automatic rollback of an annotate request
+// reason: why the rollout failed, one of CrashLoopBackOff, TooManyRestarts, ProgressDeadlineExceeded and RolloutTimeout
+// message: details about the failure, e.g. the failing pod and container
+// annotations: the logz.io annotations restored to the pod template
+type Rollback struct {
+	Reason      string            `json:"reason"`
+	Message     string            `json:"message"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// rolloutFailure is returned by waitForRollout when the rollout fails the health criteria of the rollback policy
+type rolloutFailure struct {
+	reason  string
+	message string
+}
+
+func (f *rolloutFailure) Error() string {
+	return fmt.Sprintf("rollout failed: %s: %s", f.reason, f.message)
+}
+
+// policy returns the policy if it is enabled, nil otherwise
+func (p *RollbackPolicy) policy() *RollbackPolicy {
+	if p == nil || !p.Enabled {
+		return nil
+	}
+	return p
+}
+
+// deadlineFailure returns a rolloutFailure for a rollout that didn't complete before the request deadline if a rollback policy
+// is set, err otherwise. The progress deadline of deployments is usually longer than the request timeout, and statefulsets have none.
+func deadlineFailure(err error, policy *RollbackPolicy) error {
+	if policy == nil || !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &rolloutFailure{reason: ReasonRolloutTimeout, message: "the rollout didn't complete within the request timeout"}
+}
+
+// checkRolloutHealth lists the pods of the workload and returns a rolloutFailure if the rollout fails the policy
+func checkRolloutHealth(ctx context.Context, clientset kubernetes.Interface, namespace string, workload *WorkloadStatus, policy *RollbackPolicy) error {
+	if workload.progressDeadlineExceeded {
+		return &rolloutFailure{reason: ReasonProgressDeadlineExceeded, message: "the rollout exceeded the progress deadline of the deployment"}
+	}
+	pods, err := listPods(ctx, clientset, namespace, workload)
+	if err != nil {
+		return err
+	}
+	workload.Pods = pods
+	// only the pods of the updated pod template count, the old pods may have been failing before the change
+	for _, podList := range [][]PodStatus{pods.Unready, pods.Ready} {
+		for _, pod := range podList {
+			if !pod.Updated {
+				continue
+			}
+			for _, container := range pod.Containers {
+				if container.Reason == ReasonCrashLoopBackOff {
+					return &rolloutFailure{reason: ReasonCrashLoopBackOff, message: fmt.Sprintf("container %s of pod %s is in CrashLoopBackOff", container.Name, pod.Name)}
+				}
+				if policy.MaxRestarts > 0 && container.RestartCount > policy.MaxRestarts {
+					return &rolloutFailure{reason: ReasonTooManyRestarts,
+						message: fmt.Sprintf("container %s of pod %s restarted %d times", container.Name, pod.Name, container.RestartCount)}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// restoredAnnotations returns the logz.io annotations that restore previous over the current ones. The instrumentor only removes
+// the agent if logz.io/traces_instrument is rollback, so the annotation is set to rollback instead of being removed if previous
+// didn't instrument the workload and current does.
+func restoredAnnotations(previous, current map[string]string) map[string]string {
+	restored := make(map[string]string, len(previous)+1)
+	for key, value := range previous {
+		restored[key] = value
+	}
+	if _, ok := previous[api.InstrumentationAnnotation]; !ok && current[api.InstrumentationAnnotation] == api.InstrumentValue {
+		restored[api.InstrumentationAnnotation] = api.RollbackValue
+	}
+	return restored
+}
+
+// desiredStateOf returns the state the crd converges to for the given logz.io pod template annotations, limited to the scope of request
+func desiredStateOf(request ResourceAnnotateRequest, annotations map[string]string, instrumentable bool) desiredState {
+	resource := ResourceAnnotateRequest{ContainerName: request.ContainerName, LogType: annotations[api.LogTypeAnnotation], scope: request.scope}
+	if annotations[api.InstrumentationAnnotation] == api.InstrumentValue {
+		resource.ServiceName = annotations[api.ServiceNameAnnotation]
+	}
+	return newDesiredState(resource, instrumentable)
+}
@@ -0,0 +1,240 @@
+package annotate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/config"
+	"github.com/logzio/easy-connect-server/api/operations"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// appNameLabel is the recommended label that holds the name of the application of a workload
+const appNameLabel = "app.kubernetes.io/name"
+
+// invalidServiceNameCharacters matches the characters that aren't allowed in a service name
+var invalidServiceNameCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// ServiceNameConflict is the details of the error returned for a service name used by other workloads
+// service_name: the requested service name
+// workloads: the other workloads whose pod template has the service name
+// suggestions: service names derived from the workload that no other workload uses
+type ServiceNameConflict struct {
+	ServiceName string                `json:"service_name"`
+	Workloads   []operations.Workload `json:"workloads"`
+	Suggestions []string              `json:"suggestions"`
+}
+
+// ServiceNameValidationRequest is the JSON body of the service name validation request
+// name, namespace, controller_kind and container_name: the container the service name is meant for
+// service_name: the service name to check, only suggestions are returned if it is empty
+type ServiceNameValidationRequest struct {
+	Name           string `json:"name"`
+	Namespace      string `json:"namespace"`
+	ControllerKind string `json:"controller_kind"`
+	ContainerName  string `json:"container_name"`
+	ServiceName    string `json:"service_name,omitempty"`
+}
+
+// ServiceNameValidation is the result of a service name validation
+// service_name: the checked service name
+// valid: whether the service name has a valid format and no other workload uses it, omitted if no service name was given
+// violations: why the format of the service name is invalid
+// conflicts: the other workloads whose pod template has the service name
+// conflict_policy: whether annotate requests reject a conflicting service name or accept it with a warning
+// suggestions: service names derived from the workload that are valid and that no other workload uses
+type ServiceNameValidation struct {
+	ServiceName    string                `json:"service_name,omitempty"`
+	Valid          *bool                 `json:"valid,omitempty"`
+	Violations     []Violation           `json:"violations"`
+	Conflicts      []operations.Workload `json:"conflicts"`
+	ConflictPolicy string                `json:"conflict_policy"`
+	Suggestions    []string              `json:"suggestions"`
+}
+
+// ValidateServiceName checks a service name for a container against the format rules and the service names of the other
+// workloads of the cluster, and suggests service names derived from the workload
+func (h *Handler) ValidateServiceName(w http.ResponseWriter, r *http.Request) {
+	logger := h.app.Logger
+	var request ServiceNameValidationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+err.Error()))
+		return
+	}
+	resource := ResourceAnnotateRequest{
+		Name:           request.Name,
+		Namespace:      request.Namespace,
+		ControllerKind: strings.ToLower(request.ControllerKind),
+		ContainerName:  request.ContainerName,
+	}
+	if !h.validate(w, r, resource, nil, nil) {
+		return
+	}
+	template, err := getPodTemplate(r.Context(), h.app, resource)
+	if err != nil {
+		if api.RequestCancelled(r, logger, "get "+resource.ControllerKind) {
+			return
+		}
+		logger.Error(api.ErrorGet, zap.Error(err))
+		api.WriteError(w, r, api.FromKubernetesError(api.ErrorGet, err))
+		return
+	}
+	inUse, err := serviceNamesInUse(r.Context(), h.app.Clientset, workloadOf(resource))
+	if err != nil {
+		if api.RequestCancelled(r, logger, "list workloads") {
+			return
+		}
+		logger.Error(api.ErrorList, zap.Error(err))
+		api.WriteError(w, r, api.FromKubernetesError(api.ErrorList, err))
+		return
+	}
+	response := ServiceNameValidation{
+		ServiceName:    request.ServiceName,
+		Violations:     []Violation{},
+		Conflicts:      []operations.Workload{},
+		ConflictPolicy: h.conflictPolicy(resource),
+		Suggestions:    suggestServiceNames(resource, template, inUse),
+	}
+	if request.ServiceName != "" {
+		var v validation
+		v.validateServiceName(request.ServiceName)
+		if v.violations != nil {
+			response.Violations = v.violations
+		}
+		if conflicts, ok := inUse[request.ServiceName]; ok {
+			response.Conflicts = conflicts
+		}
+		valid := len(response.Violations) == 0 && len(response.Conflicts) == 0
+		response.Valid = &valid
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// checkServiceName looks for other workloads with the service name a request sets, nil if it doesn't set one. With the reject
+// policy a conflict is written to w as an error and false is returned, with the warn policy it is added to the warnings of resource.
+func (h *Handler) checkServiceName(w http.ResponseWriter, r *http.Request, resource *ResourceAnnotateRequest, serviceName *string) bool {
+	if serviceName == nil {
+		return true
+	}
+	logger := h.app.Logger
+	inUse, err := serviceNamesInUse(r.Context(), h.app.Clientset, workloadOf(*resource))
+	if err != nil {
+		if api.RequestCancelled(r, logger, "list workloads") {
+			return false
+		}
+		logger.Error(api.ErrorList, zap.Error(err))
+		api.WriteError(w, r, api.FromKubernetesError(api.ErrorList, err))
+		return false
+	}
+	conflicts, ok := inUse[*serviceName]
+	if !ok {
+		return true
+	}
+	if h.conflictPolicy(*resource) == config.ConflictReject {
+		var suggestions []string
+		if template, err := getPodTemplate(r.Context(), h.app, *resource); err == nil {
+			suggestions = suggestServiceNames(*resource, template, inUse)
+		}
+		if suggestions == nil {
+			suggestions = []string{}
+		}
+		logger.Infow(api.ErrorServiceNameConflict+*serviceName, "workloads", conflicts, "request_id", api.RequestIDFrom(r.Context()))
+		api.WriteError(w, r, api.NewError(http.StatusConflict, api.CodeConflict, api.ErrorServiceNameConflict+*serviceName).
+			WithDetails(ServiceNameConflict{ServiceName: *serviceName, Workloads: conflicts, Suggestions: suggestions}))
+		return false
+	}
+	names := make([]string, 0, len(conflicts))
+	for _, workload := range conflicts {
+		names = append(names, fmt.Sprintf("%s %s/%s", workload.Kind, workload.Namespace, workload.Name))
+	}
+	logger.Warnw("Service name is used by other workloads", "service_name", *serviceName, "workloads", conflicts, "request_id", api.RequestIDFrom(r.Context()))
+	resource.warnings = append(resource.warnings, fmt.Sprintf("service name %q is also used by %s", *serviceName, strings.Join(names, ", ")))
+	return true
+}
+
+// conflictPolicy returns the service name conflict policy of a request, the configured one if the request doesn't set it
+func (h *Handler) conflictPolicy(resource ResourceAnnotateRequest) string {
+	if resource.ServiceNameConflicts != "" {
+		return resource.ServiceNameConflicts
+	}
+	if h.app.Config == nil || h.app.Config.ServiceNameConflicts == "" {
+		return config.ConflictWarn
+	}
+	return h.app.Config.ServiceNameConflicts
+}
+
+// serviceNamesInUse returns the deployments and statefulsets of all namespaces by the service name of their pod template,
+// except the workload self
+func serviceNamesInUse(ctx context.Context, clientset kubernetes.Interface, self operations.Workload) (map[string][]operations.Workload, error) {
+	inUse := map[string][]operations.Workload{}
+	add := func(kind, namespace, name string, template corev1.PodTemplateSpec) {
+		workload := operations.Workload{Namespace: namespace, Kind: kind, Name: name}
+		serviceName := template.Annotations[api.ServiceNameAnnotation]
+		if serviceName == "" || workload == self {
+			return
+		}
+		inUse[serviceName] = append(inUse[serviceName], workload)
+	}
+	deployments, err := clientset.AppsV1().Deployments("").List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, deployment := range deployments.Items {
+		add(api.KindDeployment, deployment.Namespace, deployment.Name, deployment.Spec.Template)
+	}
+	statefulSets, err := clientset.AppsV1().StatefulSets("").List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, statefulSet := range statefulSets.Items {
+		add(api.KindStatefulSet, statefulSet.Namespace, statefulSet.Name, statefulSet.Spec.Template)
+	}
+	return inUse, nil
+}
+
+// suggestServiceNames derives service names from the app.kubernetes.io/name label of the pod template, the workload name
+// and the container name, in this order. Names other workloads use are skipped.
+func suggestServiceNames(resource ResourceAnnotateRequest, template *corev1.PodTemplateSpec, inUse map[string][]operations.Workload) []string {
+	candidates := []string{template.Labels[appNameLabel], resource.Name}
+	if resource.ContainerName != "" {
+		candidates = append(candidates, resource.ContainerName, resource.Name+"-"+resource.ContainerName)
+	}
+	suggestions := []string{}
+	seen := map[string]bool{}
+	for _, candidate := range candidates {
+		name := sanitizeServiceName(candidate)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if _, ok := inUse[name]; !ok {
+			suggestions = append(suggestions, name)
+		}
+	}
+	return suggestions
+}
+
+// sanitizeServiceName replaces the characters a service name can't have with '-' and shortens it to the longest service name
+// accepted, it returns an empty string if nothing is left
+func sanitizeServiceName(name string) string {
+	name = invalidServiceNameCharacters.ReplaceAllString(name, "-")
+	name = strings.TrimLeft(name, "._-")
+	if len(name) > maxServiceNameLength {
+		name = name[:maxServiceNameLength]
+	}
+	return strings.TrimRight(name, "._-")
+}
+
+// workloadOf returns the workload of a request
+func workloadOf(resource ResourceAnnotateRequest) operations.Workload {
+	return operations.Workload{Namespace: resource.Namespace, Kind: resource.ControllerKind, Name: resource.Name}
+}
@@ -0,0 +1,103 @@
+package annotate
+
+import (
+	"encoding/json"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/config"
+	"github.com/logzio/easy-connect-server/api/operations"
+	"github.com/logzio/easy-connect-server/api/simulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newConflictTestApp creates an App with adservice and a cartservice statefulset in another namespace that uses the ads service name
+func newConflictTestApp(t *testing.T) *api.App {
+	deployment := simulator.Deployment(testNamespace, "adservice", "server")
+	deployment.Spec.Template.Labels[appNameLabel] = "ads"
+	other := simulator.StatefulSet("shop", "cartservice", "server")
+	other.Spec.Template.Annotations = map[string]string{api.ServiceNameAnnotation: "ads"}
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	return newTestApp(t, 5, deployment, other, crd)
+}
+
+func TestUpdateResourceAnnotationsServiceNameConflict(t *testing.T) {
+	cartservice := operations.Workload{Namespace: "shop", Kind: api.KindStatefulSet, Name: "cartservice"}
+	t.Run("reject", func(t *testing.T) {
+		app := newConflictTestApp(t)
+		request := ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment, ContainerName: "server", ServiceName: "ads"}
+		request.ServiceNameConflicts = config.ConflictReject
+		recorder := annotate(t, app, request)
+		require.Equal(t, http.StatusConflict, recorder.Code, recorder.Body.String())
+		var apiErr struct {
+			Details ServiceNameConflict `json:"details"`
+		}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &apiErr))
+		assert.Equal(t, []operations.Workload{cartservice}, apiErr.Details.Workloads)
+		assert.Equal(t, []string{"adservice", "server", "adservice-server"}, apiErr.Details.Suggestions, "the label is taken")
+		assert.Empty(t, app.Operations.List(workloadOf(request)), "nothing is changed")
+	})
+	t.Run("warn", func(t *testing.T) {
+		app := newConflictTestApp(t)
+		startInstrumentor(t, app)
+		recorder := annotate(t, app, ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment, ContainerName: "server", ServiceName: "ads"})
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		var response ResourceAnnotateResponse
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Equal(t, []string{`service name "ads" is also used by statefulset shop/cartservice`}, response.Warnings)
+	})
+	t.Run("invalid policy", func(t *testing.T) {
+		app := newConflictTestApp(t)
+		request := ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment, ContainerName: "server", ServiceName: "ads"}
+		request.ServiceNameConflicts = "ignore"
+		recorder := annotate(t, app, request)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "service_name_conflicts")
+	})
+}
+
+func TestValidateServiceName(t *testing.T) {
+	app := newConflictTestApp(t)
+	app.Config.ServiceNameConflicts = config.ConflictReject
+	validate := func(body string) (*httptest.ResponseRecorder, ServiceNameValidation) {
+		recorder := httptest.NewRecorder()
+		NewHandler(app).ValidateServiceName(recorder, httptest.NewRequest(http.MethodPost, "/api/v1/service-names/validate", strings.NewReader(body)))
+		var response ServiceNameValidation
+		if recorder.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		}
+		return recorder, response
+	}
+	workload := `"name":"adservice","namespace":"default","controller_kind":"Deployment","container_name":"server"`
+
+	recorder, response := validate(`{` + workload + `,"service_name":"ads"}`)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.False(t, *response.Valid)
+	assert.Equal(t, []operations.Workload{{Namespace: "shop", Kind: api.KindStatefulSet, Name: "cartservice"}}, response.Conflicts)
+	assert.Equal(t, config.ConflictReject, response.ConflictPolicy)
+	assert.Equal(t, []string{"adservice", "server", "adservice-server"}, response.Suggestions)
+
+	_, response = validate(`{` + workload + `,"service_name":"-ads"}`)
+	assert.False(t, *response.Valid)
+	assert.Equal(t, "service_name", response.Violations[0].Field)
+
+	_, response = validate(`{` + workload + `,"service_name":"adservice"}`)
+	assert.True(t, *response.Valid)
+
+	_, response = validate(`{` + workload + `}`)
+	assert.Nil(t, response.Valid, "only suggestions are returned without a service name")
+	assert.NotEmpty(t, response.Suggestions)
+
+	recorder, _ = validate(`{"name":"adservice","namespace":"default","controller_kind":"cronjob"}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestSanitizeServiceName(t *testing.T) {
+	assert.Equal(t, "my-app", sanitizeServiceName("my app"))
+	assert.Equal(t, "app", sanitizeServiceName("_app."))
+	assert.Equal(t, "", sanitizeServiceName("@@"))
+	assert.Len(t, sanitizeServiceName(strings.Repeat("a", 100)), maxServiceNameLength)
+}
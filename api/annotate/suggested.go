@@ -0,0 +1,231 @@
+package annotate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/config"
+	"github.com/logzio/easy-connect-server/api/state"
+	"go.uber.org/zap"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8svalidation "k8s.io/apimachinery/pkg/util/validation"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	// SuggestionApplied is the status of a workload whose log type was set to the suggested one
+	SuggestionApplied = "applied"
+	// SuggestionPlanned is the status of a workload whose log type would be set by a request without dry_run
+	SuggestionPlanned = "planned"
+	// SuggestionSkipped is the status of a workload whose log type isn't changed
+	SuggestionSkipped = "skipped"
+	// SuggestionFailed is the status of a workload whose annotate request failed
+	SuggestionFailed = "failed"
+)
+
+// SuggestedLogTypesRequest is the optional JSON body of the request that applies the suggested log types of a namespace
+// dry_run: only report the workloads that would be changed
+// overwrite: also replace log types that are already set, only workloads without a log type are changed otherwise
+// wait_for_turn: as in the annotate request, for every workload
+// include_languages: also apply the log types suggested for detected languages, only the ones of detected applications are applied otherwise
+type SuggestedLogTypesRequest struct {
+	DryRun           bool `json:"dry_run,omitempty"`
+	Overwrite        bool `json:"overwrite,omitempty"`
+	WaitForTurn      bool `json:"wait_for_turn,omitempty"`
+	IncludeLanguages bool `json:"include_languages,omitempty"`
+}
+
+// SuggestedLogTypeResult is the outcome of the request for a workload
+// name, controller_kind: the workload
+// container_name: the container whose detected application or language the log type is suggested for
+// log_type: the log type of the workload before the request
+// suggested_log_type: the suggested log type, omitted if there is none
+// status: applied, planned, skipped or failed
+// reason: why the workload was skipped
+// operation_id: the operation of the change, for applied workloads
+// error: the error of the annotate request, for failed workloads
+type SuggestedLogTypeResult struct {
+	Name             string     `json:"name"`
+	ControllerKind   string     `json:"controller_kind"`
+	ContainerName    string     `json:"container_name,omitempty"`
+	LogType          string     `json:"log_type"`
+	SuggestedLogType string     `json:"suggested_log_type,omitempty"`
+	Status           string     `json:"status"`
+	Reason           string     `json:"reason,omitempty"`
+	OperationID      string     `json:"operation_id,omitempty"`
+	Error            *api.Error `json:"error,omitempty"`
+}
+
+// SuggestedLogTypesResponse is the response of the request that applies the suggested log types of a namespace
+// namespace: the namespace of the workloads
+// dry_run: whether the workloads were left unchanged
+// results: the outcome for every workload of the namespace, sorted by name
+type SuggestedLogTypesResponse struct {
+	Namespace string                   `json:"namespace"`
+	DryRun    bool                     `json:"dry_run"`
+	Results   []SuggestedLogTypeResult `json:"results"`
+}
+
+// ApplySuggestedLogTypes sets the log type of every workload of a namespace to the log type suggested for its detected
+// containers. Every workload is changed like a PATCH /api/v1/annotate request that only sets the log type, one at a time.
+// The request timeout bounds the whole request, the workloads that weren't changed once it passed are skipped.
+func (h *Handler) ApplySuggestedLogTypes(w http.ResponseWriter, r *http.Request) {
+	logger := h.app.Logger
+	namespace := mux.Vars(r)["namespace"]
+	if messages := k8svalidation.IsDNS1123Label(namespace); len(messages) > 0 {
+		api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+"namespace "+strings.Join(messages, ", ")).
+			WithDetails(ValidationErrors{Violations: []Violation{{Field: "namespace", Message: strings.Join(messages, ", ")}}}))
+		return
+	}
+	var request SuggestedLogTypesRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+err.Error()))
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), h.app.RequestTimeout())
+	defer cancel()
+	list, err := h.app.DynamicClient.Resource(api.InstrumentedApplicationGVR).Namespace(namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		if api.RequestCancelled(r, logger, "list instrumented applications") {
+			return
+		}
+		logger.Error(api.ErrorList, zap.Error(err))
+		api.WriteError(w, r, api.FromKubernetesError(api.ErrorList, err))
+		return
+	}
+	response := SuggestedLogTypesResponse{Namespace: namespace, DryRun: request.DryRun, Results: []SuggestedLogTypeResult{}}
+	for _, item := range list.Items {
+		if api.IsInternalResource(item.GetName()) {
+			continue
+		}
+		result := suggestLogType(state.FromInstrumentedApplication(&item), request)
+		switch {
+		case result.Status != SuggestionPlanned || request.DryRun:
+		case ctx.Err() != nil:
+			result.Status, result.Reason = SuggestionSkipped, "the request timeout passed before the workload was changed"
+		default:
+			h.applySuggestedLogType(r.WithContext(ctx), namespace, request, &result)
+			if api.RequestCancelled(r, logger, "apply suggested log types") {
+				return
+			}
+		}
+		response.Results = append(response.Results, result)
+	}
+	sort.Slice(response.Results, func(i, j int) bool { return response.Results[i].Name < response.Results[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// suggestLogType chooses the log type of a workload from the suggested log types of its containers, only the containers with a
+// detected application count unless the request includes languages. The workload is skipped if no container or containers with
+// different log types have a suggestion, or if its log type is set and the request doesn't overwrite it.
+func suggestLogType(containers []state.InstrumentdApplicationData, request SuggestedLogTypesRequest) SuggestedLogTypeResult {
+	workload := containers[0]
+	result := SuggestedLogTypeResult{Name: workload.Name, ControllerKind: workload.ControllerKind, Status: SuggestionSkipped}
+	if workload.LogType != nil {
+		result.LogType = *workload.LogType
+	}
+	var suggested []string
+	languagesSkipped := false
+	for _, container := range containers {
+		if container.SuggestedLogType == nil {
+			continue
+		}
+		if container.Application == nil && !request.IncludeLanguages {
+			languagesSkipped = true
+			continue
+		}
+		if result.SuggestedLogType == "" {
+			result.SuggestedLogType, result.ContainerName = *container.SuggestedLogType, *container.ContainerName
+		}
+		if !config.Contains(suggested, *container.SuggestedLogType) {
+			suggested = append(suggested, *container.SuggestedLogType)
+		}
+	}
+	switch {
+	case len(suggested) == 0 && languagesSkipped:
+		result.Reason = "a log type is only suggested for the detected languages, use include_languages to apply it"
+	case len(suggested) == 0:
+		result.Reason = "no log type is suggested for the detected containers"
+	case len(suggested) > 1:
+		result.SuggestedLogType, result.ContainerName = "", ""
+		result.Reason = fmt.Sprintf("the containers have different suggested log types: %s", strings.Join(suggested, ", "))
+	case result.LogType == result.SuggestedLogType:
+		result.Reason = "the log type is the suggested one"
+	case result.LogType != "" && !request.Overwrite:
+		result.Reason = "the log type is set, use overwrite to replace it"
+	default:
+		result.Status = SuggestionPlanned
+	}
+	return result
+}
+
+// applySuggestedLogType sets the log type of the workload of result to the suggested one like PATCH /api/v1/annotate, and
+// updates result with the outcome
+func (h *Handler) applySuggestedLogType(r *http.Request, namespace string, request SuggestedLogTypesRequest, result *SuggestedLogTypeResult) {
+	logType := result.SuggestedLogType
+	resource := ResourceAnnotateRequest{
+		Name:           result.Name,
+		Namespace:      namespace,
+		ControllerKind: result.ControllerKind,
+		ContainerName:  result.ContainerName,
+		LogType:        logType,
+		Options:        Options{WaitForTurn: request.WaitForTurn},
+		scope:          scopeLogs,
+	}
+	buffer := &bufferedResponse{header: http.Header{}}
+	if h.validate(buffer, r, resource, &logType, nil) {
+		h.applyPatch(buffer, r, resource, ResourcePatchRequest{LogType: NullableString{Set: true, Value: &logType}})
+	}
+	switch {
+	case buffer.status == http.StatusOK:
+		var response ResourceAnnotateResponse
+		if err := json.Unmarshal(buffer.body.Bytes(), &response); err != nil {
+			result.Status, result.Error = SuggestionFailed, api.NewError(http.StatusInternalServerError, api.CodeInternal, err.Error())
+			return
+		}
+		result.Status, result.OperationID = SuggestionApplied, response.OperationID
+	case buffer.status != 0:
+		apiErr := &api.Error{}
+		if err := json.Unmarshal(buffer.body.Bytes(), apiErr); err != nil {
+			apiErr = api.NewError(buffer.status, api.CodeInternal, buffer.body.String())
+		}
+		apiErr.Status = buffer.status
+		result.Status, result.Error = SuggestionFailed, apiErr
+	default:
+		// nothing is written if the client disconnected, the bulk request stops then
+		result.Status, result.Error = SuggestionFailed, api.NewError(http.StatusGatewayTimeout, api.CodeTimeout, api.ErrorTimeout+result.Name)
+	}
+}
+
+// bufferedResponse keeps the response of a request the server runs for itself, e.g. for every workload of a bulk request
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(data)
+}
@@ -0,0 +1,130 @@
+package annotate
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/simulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplySuggestedLogTypes(t *testing.T) {
+	frontend := simulator.InstrumentedApplication(testNamespace, "frontend", "Deployment", nil, []interface{}{simulator.Application("proxy", "nginx")})
+	adservice := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	adservice.Object["spec"].(map[string]interface{})["logType"] = "python"
+	checkout := simulator.InstrumentedApplication(testNamespace, "checkout", "Deployment",
+		[]interface{}{simulator.Language("server", "go")}, []interface{}{simulator.Application("cache", "redis")})
+	adserviceDeployment := simulator.Deployment(testNamespace, "adservice", "server")
+	adserviceDeployment.Spec.Template.Annotations = map[string]string{api.LogTypeAnnotation: "python"}
+	loadgenerator := simulator.InstrumentedApplication(testNamespace, "loadgenerator", "Deployment", nil, nil)
+	// the instrumentor may write an empty list of languages
+	worker := simulator.InstrumentedApplication(testNamespace, "worker", "Deployment", nil, nil)
+	worker.Object["spec"].(map[string]interface{})["languages"] = []interface{}{}
+	app := newTestApp(t, 5,
+		simulator.Deployment(testNamespace, "frontend", "proxy"), frontend,
+		adserviceDeployment, adservice,
+		simulator.Deployment(testNamespace, "checkout", "server", "cache"), checkout,
+		simulator.Deployment(testNamespace, "loadgenerator", "main"), loadgenerator,
+		simulator.Deployment(testNamespace, "worker", "main"), worker,
+	)
+	startInstrumentor(t, app)
+	apply := func(body string) SuggestedLogTypesResponse {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/namespaces/default/suggested-log-types/apply", strings.NewReader(body))
+		NewHandler(app).ApplySuggestedLogTypes(recorder, mux.SetURLVars(request, map[string]string{"namespace": testNamespace}))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		var response SuggestedLogTypesResponse
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		return response
+	}
+	statuses := func(response SuggestedLogTypesResponse) map[string]string {
+		result := map[string]string{}
+		for _, r := range response.Results {
+			result[r.Name] = r.Status
+		}
+		return result
+	}
+
+	response := apply(`{"dry_run": true}`)
+	assert.True(t, response.DryRun)
+	assert.Equal(t, map[string]string{"adservice": SuggestionSkipped, "checkout": SuggestionPlanned, "frontend": SuggestionPlanned, "loadgenerator": SuggestionSkipped, "worker": SuggestionSkipped}, statuses(response))
+	assert.Equal(t, "a log type is only suggested for the detected languages, use include_languages to apply it", response.Results[0].Reason)
+	assert.Equal(t, "redis", response.Results[1].SuggestedLogType, "only the detected applications count")
+	assert.Equal(t, "no log type is suggested for the detected containers", response.Results[4].Reason)
+	logType := func(name string) string {
+		return getCrd(t, app, name).Object["spec"].(map[string]interface{})["logType"].(string)
+	}
+	assert.Equal(t, "", logType("frontend"), "a dry run changes nothing")
+
+	response = apply("")
+	assert.Equal(t, map[string]string{"adservice": SuggestionSkipped, "checkout": SuggestionApplied, "frontend": SuggestionApplied, "loadgenerator": SuggestionSkipped, "worker": SuggestionSkipped}, statuses(response))
+	frontendResult := response.Results[2]
+	assert.Equal(t, "proxy", frontendResult.ContainerName)
+	assert.Equal(t, "nginx", frontendResult.SuggestedLogType)
+	assert.NotEmpty(t, frontendResult.OperationID)
+	assert.Equal(t, "nginx", logType("frontend"))
+	assert.Equal(t, "redis", logType("checkout"))
+	assert.Equal(t, "python", logType("adservice"), "the language suggestions aren't applied by default")
+
+	response = apply(`{"include_languages": true}`)
+	assert.Equal(t, "the log type is set, use overwrite to replace it", response.Results[0].Reason)
+	assert.Equal(t, "the containers have different suggested log types: golang, redis", response.Results[1].Reason)
+
+	response = apply(`{"include_languages": true, "overwrite": true}`)
+	assert.Equal(t, SuggestionApplied, response.Results[0].Status)
+	assert.Equal(t, "python", response.Results[0].LogType)
+	assert.Equal(t, "java", logType("adservice"))
+	assert.Equal(t, "the log type is the suggested one", response.Results[2].Reason)
+}
+
+func TestApplySuggestedLogTypesFailure(t *testing.T) {
+	// the workload of the custom resource doesn't exist, so the annotate request fails
+	crd := simulator.InstrumentedApplication(testNamespace, "frontend", "Deployment", nil, []interface{}{simulator.Application("proxy", "nginx")})
+	app := newTestApp(t, 1, crd)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/namespaces/default/suggested-log-types/apply", nil)
+	NewHandler(app).ApplySuggestedLogTypes(recorder, mux.SetURLVars(request, map[string]string{"namespace": testNamespace}))
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var response SuggestedLogTypesResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Len(t, response.Results, 1)
+	assert.Equal(t, SuggestionFailed, response.Results[0].Status)
+	assert.Equal(t, api.CodeNotFound, response.Results[0].Error.Code)
+
+	recorder = httptest.NewRecorder()
+	NewHandler(app).ApplySuggestedLogTypes(recorder, mux.SetURLVars(request, map[string]string{"namespace": "Default"}))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestApplySuggestedLogTypesTimeout(t *testing.T) {
+	// no instrumentor runs, so the first workload waits for its custom resource until the request timeout passes
+	frontend := simulator.InstrumentedApplication(testNamespace, "frontend", "Deployment", nil, []interface{}{simulator.Application("proxy", "nginx")})
+	redis := simulator.InstrumentedApplication(testNamespace, "redis", "Deployment", nil, []interface{}{simulator.Application("redis", "redis")})
+	app := newTestApp(t, 1, simulator.Deployment(testNamespace, "frontend", "proxy"), frontend, simulator.Deployment(testNamespace, "redis", "redis"), redis)
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/namespaces/default/suggested-log-types/apply", nil)
+	start, cancelled := time.Now(), api.MetricValue(api.MetricCancelledRequests)
+	NewHandler(app).ApplySuggestedLogTypes(recorder, mux.SetURLVars(request, map[string]string{"namespace": testNamespace}))
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Less(t, time.Since(start), 2*time.Second, "one deadline bounds all the workloads")
+	assert.Equal(t, cancelled, api.MetricValue(api.MetricCancelledRequests), "the deadline isn't counted as a client cancellation")
+
+	var response SuggestedLogTypesResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Len(t, response.Results, 2)
+	failed, skipped := response.Results[0], response.Results[1]
+	if failed.Status != SuggestionFailed {
+		// the workloads are changed in the order they are listed
+		failed, skipped = skipped, failed
+	}
+	assert.Equal(t, SuggestionFailed, failed.Status)
+	assert.Equal(t, api.CodeTimeout, failed.Error.Code)
+	assert.Equal(t, SuggestionSkipped, skipped.Status)
+	assert.Equal(t, "the request timeout passed before the workload was changed", skipped.Reason)
+}
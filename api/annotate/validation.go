@@ -0,0 +1,195 @@
+package annotate
+
+import (
+	"context"
+	"fmt"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/config"
+	"github.com/logzio/easy-connect-server/api/logtypes"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8svalidation "k8s.io/apimachinery/pkg/util/validation"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	// maxServiceNameLength is the longest service name accepted
+	maxServiceNameLength = 63
+)
+
+// serviceNamePattern allows letters, digits, '.', '_' and '-', starting with a letter or a digit
+var serviceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Violation is a field of a request with an invalid value
+// field: the JSON name of the field, or the name of the path parameter
+// message: why the value is invalid
+type Violation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is the details of the error returned for an invalid request
+// violations: every invalid field of the request
+type ValidationErrors struct {
+	Violations []Violation `json:"violations"`
+}
+
+// validation collects the violations of a request
+type validation struct {
+	violations []Violation
+}
+
+func (v *validation) add(field, format string, args ...interface{}) {
+	v.violations = append(v.violations, Violation{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// validateFields checks the format of the fields of a request. logType and serviceName are the values the request sets,
+// nil if it doesn't set them.
+func (v *validation) validateFields(resource ResourceAnnotateRequest, logType, serviceName *string) {
+	if resource.Name == "" {
+		v.add("name", "is required")
+	} else if messages := k8svalidation.IsDNS1123Subdomain(resource.Name); len(messages) > 0 {
+		v.add("name", "%s", strings.Join(messages, ", "))
+	}
+	if resource.Namespace == "" {
+		v.add("namespace", "is required")
+	} else if messages := k8svalidation.IsDNS1123Label(resource.Namespace); len(messages) > 0 {
+		v.add("namespace", "%s", strings.Join(messages, ", "))
+	}
+	if !isValidResourceAnnotateRequest(resource) {
+		v.add("controller_kind", "must be one of %s", strings.Join(api.ValidKinds, ", "))
+	}
+	if resource.ContainerName != "" {
+		if messages := k8svalidation.IsDNS1123Label(resource.ContainerName); len(messages) > 0 {
+			v.add("container_name", "%s", strings.Join(messages, ", "))
+		}
+	}
+	if logType != nil {
+		switch {
+		case len(*logType) > logtypes.MaxNameLength:
+			v.add("log_type", "must be at most %d characters", logtypes.MaxNameLength)
+		case !logtypes.NamePattern.MatchString(*logType):
+			v.add("log_type", "must consist of lowercase letters, digits, '_' or '-', and start with a letter or a digit")
+		}
+	}
+	if serviceName != nil {
+		v.validateServiceName(*serviceName)
+	}
+	if policy := resource.ServiceNameConflicts; policy != "" && policy != config.ConflictWarn && policy != config.ConflictReject {
+		v.add("service_name_conflicts", "must be one of %s", strings.Join(config.ValidConflictPolicies, ", "))
+	}
+}
+
+// validateServiceName checks the format of a service name
+func (v *validation) validateServiceName(serviceName string) {
+	switch {
+	case len(serviceName) > maxServiceNameLength:
+		v.add("service_name", "must be at most %d characters", maxServiceNameLength)
+	case !serviceNamePattern.MatchString(serviceName):
+		v.add("service_name", "must consist of letters, digits, '.', '_' or '-', and start with a letter or a digit")
+	}
+}
+
+// validateContainer checks that the container of a request exists in the InstrumentedApplication and in the pod template of
+// the workload. A workload without detected containers is requested with an empty container name. The check is skipped if
+// the resources can't be read, the request then fails with the error of the read.
+func (v *validation) validateContainer(ctx context.Context, app *api.App, resource ResourceAnnotateRequest) {
+	crd, err := app.DynamicClient.Resource(api.InstrumentedApplicationGVR).Namespace(resource.Namespace).Get(ctx, resource.Name, v1.GetOptions{})
+	if err != nil {
+		return
+	}
+	template, err := getPodTemplate(ctx, app, resource)
+	if err != nil {
+		return
+	}
+	spec := fieldOf(crd, "spec")
+	detected := findContainer(spec["languages"], resource.ContainerName) != nil || findContainer(spec["applications"], resource.ContainerName) != nil
+	noneDetected := spec["languages"] == nil && spec["applications"] == nil
+	switch {
+	case resource.ContainerName == "" && !noneDetected:
+		v.add("container_name", "is required, the InstrumentedApplication has detected containers")
+	case resource.ContainerName != "" && !detected:
+		v.add("container_name", "container %q wasn't detected in the InstrumentedApplication", resource.ContainerName)
+	}
+	if resource.ContainerName != "" && !api.HasContainer(&template.Spec, resource.ContainerName) {
+		v.add("container_name", "container %q isn't in the pod template of the %s", resource.ContainerName, resource.ControllerKind)
+	}
+}
+
+// validateLogType checks that a log type is in the log type catalog, unless the request allows custom log types
+func (v *validation) validateLogType(ctx context.Context, catalog *logtypes.Catalog, resource ResourceAnnotateRequest, logType string) {
+	if resource.CustomLogType {
+		return
+	}
+	names := catalog.Names(ctx)
+	if names[logType] {
+		return
+	}
+	if closest := logtypes.Closest(logType, names); closest != "" {
+		v.add("log_type", "%q isn't in the log type catalog, did you mean %q? Set custom_log_type to use it anyway", logType, closest)
+		return
+	}
+	v.add("log_type", "%q isn't in the log type catalog, see /api/v1/log-types. Set custom_log_type to use it anyway", logType)
+}
+
+// pathParameters are the names of the path parameters of the container endpoints that hold the fields of a request
+var pathParameters = map[string]string{
+	"controller_kind": "kind",
+	"container_name":  "container",
+}
+
+// validate checks a request and writes its violations and the given ones to w as an error, it returns false if the request
+// is invalid. The container and the log type catalog are only checked if the fields are valid. logType and serviceName are the values the request sets.
+func (h *Handler) validate(w http.ResponseWriter, r *http.Request, resource ResourceAnnotateRequest, logType, serviceName *string, violations ...Violation) bool {
+	v := validation{violations: violations}
+	v.validateFields(resource, logType, serviceName)
+	if len(v.violations) == 0 {
+		v.validateContainer(r.Context(), h.app, resource)
+		if logType != nil {
+			v.validateLogType(r.Context(), h.logTypes, resource, *logType)
+		}
+	}
+	if len(v.violations) == 0 {
+		return true
+	}
+	messages := make([]string, 0, len(v.violations))
+	for i, violation := range v.violations {
+		// the container endpoints take the workload and the container from the path
+		if parameter, ok := pathParameters[violation.Field]; ok && resource.scope != "" {
+			v.violations[i].Field = parameter
+		}
+		messages = append(messages, v.violations[i].Field+" "+violation.Message)
+	}
+	h.app.Logger.Infow(api.ErrorInvalidInput, "violations", v.violations, "request_id", api.RequestIDFrom(r.Context()))
+	api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+strings.Join(messages, "; ")).
+		WithDetails(ValidationErrors{Violations: v.violations}))
+	return false
+}
+
+// getPodTemplate returns the pod template of the workload of a request
+func getPodTemplate(ctx context.Context, app *api.App, resource ResourceAnnotateRequest) (*corev1.PodTemplateSpec, error) {
+	switch resource.ControllerKind {
+	case api.KindStatefulSet:
+		statefulSet, err := app.Clientset.AppsV1().StatefulSets(resource.Namespace).Get(ctx, resource.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return &statefulSet.Spec.Template, nil
+	default:
+		deployment, err := app.Clientset.AppsV1().Deployments(resource.Namespace).Get(ctx, resource.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return &deployment.Spec.Template, nil
+	}
+}
+
+// stringValue returns a pointer to value, nil if it is empty
+func stringValue(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
@@ -0,0 +1,96 @@
+package annotate
+
+import (
+	"encoding/json"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/simulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidation(t *testing.T) {
+	deployment := simulator.Deployment(testNamespace, "adservice", "server")
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment",
+		[]interface{}{simulator.Language("server", "java"), simulator.Language("sidecar", "go")}, nil)
+	app := newTestApp(t, 1, deployment, crd)
+	testCases := []struct {
+		description string
+		request     ResourceAnnotateRequest
+		violations  []Violation
+	}{
+		{"every field invalid", ResourceAnnotateRequest{Name: "Ad_Service", Namespace: "", ControllerKind: "daemonset", ContainerName: "Server",
+			LogType: "Java Logs", ServiceName: "ads!"}, []Violation{
+			{Field: "name"},
+			{Field: "namespace", Message: "is required"},
+			{Field: "controller_kind", Message: "must be one of deployment, statefulset"},
+			{Field: "container_name"},
+			{Field: "log_type", Message: "must consist of lowercase letters, digits, '_' or '-', and start with a letter or a digit"},
+			{Field: "service_name", Message: "must consist of letters, digits, '.', '_' or '-', and start with a letter or a digit"},
+		}},
+		{"service name too long", ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment, ContainerName: "server",
+			ServiceName: strings.Repeat("a", maxServiceNameLength+1)}, []Violation{{Field: "service_name", Message: "must be at most 63 characters"}}},
+		{"container not detected", ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment, ContainerName: "worker"},
+			[]Violation{
+				{Field: "container_name", Message: `container "worker" wasn't detected in the InstrumentedApplication`},
+				{Field: "container_name", Message: `container "worker" isn't in the pod template of the deployment`},
+			}},
+		{"container not in the pod template", ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment, ContainerName: "sidecar"},
+			[]Violation{{Field: "container_name", Message: `container "sidecar" isn't in the pod template of the deployment`}}},
+		{"container required", ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment},
+			[]Violation{{Field: "container_name", Message: "is required, the InstrumentedApplication has detected containers"}}},
+		{"log type typo", ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment, ContainerName: "server", LogType: "ngnix"},
+			[]Violation{{Field: "log_type", Message: `"ngnix" isn't in the log type catalog, did you mean "nginx"? Set custom_log_type to use it anyway`}}},
+		{"log type not in the catalog", ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment, ContainerName: "server", LogType: "adservice-logs"},
+			[]Violation{{Field: "log_type", Message: `"adservice-logs" isn't in the log type catalog, see /api/v1/log-types. Set custom_log_type to use it anyway`}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			recorder := annotate(t, app, tc.request)
+			require.Equal(t, http.StatusBadRequest, recorder.Code, recorder.Body.String())
+			var apiErr struct {
+				Code    string           `json:"code"`
+				Details ValidationErrors `json:"details"`
+			}
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &apiErr))
+			assert.Equal(t, api.CodeInvalidInput, apiErr.Code)
+			require.Len(t, apiErr.Details.Violations, len(tc.violations))
+			for i, violation := range tc.violations {
+				assert.Equal(t, violation.Field, apiErr.Details.Violations[i].Field)
+				if violation.Message != "" {
+					assert.Equal(t, violation.Message, apiErr.Details.Violations[i].Message)
+				}
+			}
+		})
+	}
+}
+
+func TestValidationCustomLogType(t *testing.T) {
+	crd := simulator.InstrumentedApplication(testNamespace, "adservice", "Deployment", []interface{}{simulator.Language("server", "java")}, nil)
+	app := newTestApp(t, 5, simulator.Deployment(testNamespace, "adservice", "server"), crd)
+	startInstrumentor(t, app)
+	request := ResourceAnnotateRequest{Name: "adservice", Namespace: testNamespace, ControllerKind: api.KindDeployment, ContainerName: "server", LogType: "adservice-logs"}
+	request.CustomLogType = true
+	recorder := annotate(t, app, request)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var response ResourceAnnotateResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "adservice-logs", *response.LogType)
+}
+
+func TestValidationContainerEndpoints(t *testing.T) {
+	app := newTestApp(t, 1)
+	recorder := containerRequest(NewHandler(app).PutLogs, http.MethodPut, "Server", "logs", "", `{}`)
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+	var apiErr struct {
+		Details ValidationErrors `json:"details"`
+	}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &apiErr))
+	var fields []string
+	for _, violation := range apiErr.Details.Violations {
+		fields = append(fields, violation.Field)
+	}
+	assert.Equal(t, []string{"log_type", "container"}, fields, "the fields of the path are named like the path parameters")
+}
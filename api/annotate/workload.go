@@ -0,0 +1,228 @@
+package annotate
+
+import (
+	"context"
+	"errors"
+	"github.com/logzio/easy-connect-server/api"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"reflect"
+	"time"
+)
+
+// WorkloadStatus is the rollout status of the annotated workload
+// generation: the generation of the workload after the update
+// observed_generation: the generation observed by the workload controller
+// replicas: the desired number of pods
+// updated_replicas: the number of pods running the updated pod template
+// ready_replicas: the number of ready pods
+// available_replicas: the number of available pods
+// rollout_complete: whether every desired pod runs the updated pod template and is available
+// pods: the ready and unready pods of the workload, only reported when waiting for the rollout
+type WorkloadStatus struct {
+	Generation         int64       `json:"generation"`
+	ObservedGeneration int64       `json:"observed_generation"`
+	Replicas           int32       `json:"replicas"`
+	UpdatedReplicas    int32       `json:"updated_replicas"`
+	ReadyReplicas      int32       `json:"ready_replicas"`
+	AvailableReplicas  int32       `json:"available_replicas"`
+	RolloutComplete    bool        `json:"rollout_complete"`
+	Pods               *PodsReport `json:"pods,omitempty"`
+
+	selector                 *v1.LabelSelector
+	templateAnnotations      map[string]string
+	progressDeadlineExceeded bool
+}
+
+// PodsReport lists the pods of a workload by readiness
+// ready: the pods whose Ready condition is true
+// unready: the other pods, e.g. pods that are starting or crash looping
+type PodsReport struct {
+	Ready   []PodStatus `json:"ready"`
+	Unready []PodStatus `json:"unready"`
+}
+
+// PodStatus is the status of a pod of the workload
+// name: the name of the pod
+// phase: the phase of the pod, e.g. Running
+// updated: whether the pod has the logz.io annotations of the current pod template
+// containers: the status of every container of the pod
+type PodStatus struct {
+	Name       string            `json:"name"`
+	Phase      string            `json:"phase"`
+	Updated    bool              `json:"updated"`
+	Containers []ContainerStatus `json:"containers"`
+}
+
+// ContainerStatus is the status of a container of a pod
+// name: the name of the container
+// ready: whether the container passes its readiness probe
+// restart_count: how many times the container restarted
+// reason: why the container isn't running, e.g. CrashLoopBackOff
+// message: details about the reason
+// last_termination_reason: why the container last terminated, e.g. Error or OOMKilled
+// last_exit_code: the exit code of the last termination
+type ContainerStatus struct {
+	Name                  string `json:"name"`
+	Ready                 bool   `json:"ready"`
+	RestartCount          int32  `json:"restart_count"`
+	Reason                string `json:"reason,omitempty"`
+	Message               string `json:"message,omitempty"`
+	LastTerminationReason string `json:"last_termination_reason,omitempty"`
+	LastExitCode          *int32 `json:"last_exit_code,omitempty"`
+}
+
+// errShuttingDown is returned by waits that were interrupted by the server shutdown
+var errShuttingDown = errors.New("server shutting down")
+
+// rolloutPollInterval is how often the workload status is read while waiting for a rollout
+var rolloutPollInterval = time.Second
+
+// getWorkloadStatus returns the rollout status of a deployment or statefulset
+func getWorkloadStatus(ctx context.Context, clientset kubernetes.Interface, kind, namespace, name string) (*WorkloadStatus, error) {
+	switch kind {
+	case api.KindStatefulSet:
+		statefulSet, err := clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return statefulSetStatus(statefulSet), nil
+	default:
+		deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return deploymentStatus(deployment), nil
+	}
+}
+
+func deploymentStatus(deployment *appsv1.Deployment) *WorkloadStatus {
+	status := &WorkloadStatus{
+		Generation:          deployment.Generation,
+		ObservedGeneration:  deployment.Status.ObservedGeneration,
+		Replicas:            desiredReplicas(deployment.Spec.Replicas),
+		UpdatedReplicas:     deployment.Status.UpdatedReplicas,
+		ReadyReplicas:       deployment.Status.ReadyReplicas,
+		AvailableReplicas:   deployment.Status.AvailableReplicas,
+		selector:            deployment.Spec.Selector,
+		templateAnnotations: api.LogzioAnnotations(deployment.Spec.Template.Annotations),
+	}
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Status == corev1.ConditionFalse && condition.Reason == ReasonProgressDeadlineExceeded {
+			status.progressDeadlineExceeded = true
+		}
+	}
+	// same as kubectl rollout status: old pods must be gone and every updated pod available
+	status.RolloutComplete = status.ObservedGeneration >= status.Generation &&
+		status.UpdatedReplicas >= status.Replicas &&
+		deployment.Status.Replicas <= status.UpdatedReplicas &&
+		status.AvailableReplicas >= status.UpdatedReplicas
+	return status
+}
+
+func statefulSetStatus(statefulSet *appsv1.StatefulSet) *WorkloadStatus {
+	status := &WorkloadStatus{
+		Generation:          statefulSet.Generation,
+		ObservedGeneration:  statefulSet.Status.ObservedGeneration,
+		Replicas:            desiredReplicas(statefulSet.Spec.Replicas),
+		UpdatedReplicas:     statefulSet.Status.UpdatedReplicas,
+		ReadyReplicas:       statefulSet.Status.ReadyReplicas,
+		AvailableReplicas:   statefulSet.Status.AvailableReplicas,
+		selector:            statefulSet.Spec.Selector,
+		templateAnnotations: api.LogzioAnnotations(statefulSet.Spec.Template.Annotations),
+	}
+	status.RolloutComplete = status.ObservedGeneration >= status.Generation &&
+		status.UpdatedReplicas >= status.Replicas &&
+		status.ReadyReplicas >= status.Replicas &&
+		statefulSet.Status.UpdateRevision == statefulSet.Status.CurrentRevision
+	return status
+}
+
+// desiredReplicas returns the replicas of a workload spec, which default to 1
+func desiredReplicas(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+// waitForRollout reads the workload status until its rollout completes, ctx is done or the server shuts down.
+// With a rollback policy, the wait ends with a rolloutFailure as soon as the rollout fails the policy or when ctx's deadline passes.
+// The last status read is returned with the error that interrupted the wait.
+func waitForRollout(ctx context.Context, clientset kubernetes.Interface, resource ResourceAnnotateRequest, policy *RollbackPolicy, shuttingDown <-chan struct{}, logger *zap.SugaredLogger) (*WorkloadStatus, error) {
+	ticker := time.NewTicker(rolloutPollInterval)
+	defer ticker.Stop()
+	var workload *WorkloadStatus
+	for {
+		current, err := getWorkloadStatus(ctx, clientset, resource.ControllerKind, resource.Namespace, resource.Name)
+		if err != nil {
+			return workload, deadlineFailure(err, policy)
+		}
+		workload = current
+		if workload.RolloutComplete {
+			return workload, nil
+		}
+		if policy != nil {
+			if err = checkRolloutHealth(ctx, clientset, resource.Namespace, workload, policy); err != nil {
+				return workload, deadlineFailure(err, policy)
+			}
+		}
+		logger.Infow("Waiting for the rollout", "name", resource.Name, "generation", workload.Generation,
+			"updated_replicas", workload.UpdatedReplicas, "available_replicas", workload.AvailableReplicas)
+		select {
+		case <-ticker.C:
+		case <-shuttingDown:
+			return workload, errShuttingDown
+		case <-ctx.Done():
+			return workload, deadlineFailure(ctx.Err(), policy)
+		}
+	}
+}
+
+// listPods reports the pods selected by the workload
+func listPods(ctx context.Context, clientset kubernetes.Interface, namespace string, workload *WorkloadStatus) (*PodsReport, error) {
+	selector, err := v1.LabelSelectorAsSelector(workload.selector)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, v1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	report := &PodsReport{Ready: []PodStatus{}, Unready: []PodStatus{}}
+	for _, pod := range pods.Items {
+		status := newPodStatus(&pod)
+		status.Updated = reflect.DeepEqual(api.LogzioAnnotations(pod.Annotations), workload.templateAnnotations)
+		if api.PodReady(&pod) {
+			report.Ready = append(report.Ready, status)
+		} else {
+			report.Unready = append(report.Unready, status)
+		}
+	}
+	return report, nil
+}
+
+func newPodStatus(pod *corev1.Pod) PodStatus {
+	status := PodStatus{Name: pod.Name, Phase: string(pod.Status.Phase), Containers: []ContainerStatus{}}
+	for _, container := range pod.Status.ContainerStatuses {
+		containerStatus := ContainerStatus{
+			Name:         container.Name,
+			Ready:        container.Ready,
+			RestartCount: container.RestartCount,
+		}
+		if waiting := container.State.Waiting; waiting != nil {
+			containerStatus.Reason, containerStatus.Message = waiting.Reason, waiting.Message
+		} else if terminated := container.State.Terminated; terminated != nil {
+			containerStatus.Reason, containerStatus.Message = terminated.Reason, terminated.Message
+		}
+		if terminated := container.LastTerminationState.Terminated; terminated != nil {
+			exitCode := terminated.ExitCode
+			containerStatus.LastTerminationReason, containerStatus.LastExitCode = terminated.Reason, &exitCode
+		}
+		status.Containers = append(status.Containers, containerStatus)
+	}
+	return status
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/logzio/easy-connect-server/api/config"
+	"github.com/logzio/easy-connect-server/api/operations"
+	"github.com/logzio/easy-connect-server/api/watch"
+	"go.uber.org/zap"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sync"
+	"time"
+)
+
+// App owns the long-lived dependencies shared by the handlers: the configuration, the logger, the kubernetes clients,
+// the InstrumentedApplication watch and the record of operations. It is created once at startup and injected into the handlers.
+type App struct {
+	Config        *config.Config
+	Logger        *zap.SugaredLogger
+	Clientset     kubernetes.Interface
+	DynamicClient dynamic.Interface
+	Watches       *watch.Manager
+	Operations    *operations.Store
+
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+}
+
+// NewApp creates an App with kubernetes clients built from the configuration
+func NewApp(cfg *config.Config) (*App, error) {
+	logger := InitLogger(cfg)
+	restConfig, err := GetConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s%w", ErrorKubeConfig, err)
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("%s%w", ErrorDynamic, err)
+	}
+	return NewAppWithClients(cfg, logger, clientset, dynamicClient), nil
+}
+
+// NewAppWithClients creates an App with the given logger and clients, e.g. fake clients in tests
+func NewAppWithClients(cfg *config.Config, logger *zap.SugaredLogger, clientset kubernetes.Interface, dynamicClient dynamic.Interface) *App {
+	return &App{
+		Config:        cfg,
+		Logger:        logger,
+		Clientset:     clientset,
+		DynamicClient: dynamicClient,
+		Watches:       watch.NewManager(dynamicClient, InstrumentedApplicationGVR, logger),
+		Operations:    operations.NewStore(operations.DefaultLimit, logger),
+		shutdownCh:    make(chan struct{}),
+	}
+}
+
+// Start starts the app's watches, they run until ctx is done. It returns once the watches are synced.
+func (a *App) Start(ctx context.Context) error {
+	return a.Watches.Start(ctx)
+}
+
+// RequestTimeout returns the timeout for the request
+func (a *App) RequestTimeout() time.Duration {
+	return time.Duration(a.Config.RequestTimeoutSeconds) * time.Second
+}
+
+// ShutdownGracePeriod returns the time in-flight requests are given to complete once the server is asked to stop
+func (a *App) ShutdownGracePeriod() time.Duration {
+	return time.Duration(a.Config.ShutdownGracePeriodSeconds) * time.Second
+}
+
+// Shutdown signals in-flight operations that the shutdown grace period has expired and they should stop waiting
+func (a *App) Shutdown() {
+	a.shutdownOnce.Do(func() {
+		close(a.shutdownCh)
+	})
+}
+
+// ShuttingDown returns a channel that is closed once Shutdown is called
+func (a *App) ShuttingDown() <-chan struct{} {
+	return a.shutdownCh
+}
@@ -2,30 +2,53 @@ package api
 
 import (
 	"fmt"
+	"github.com/logzio/easy-connect-server/api/config"
 	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/homedir"
-	"os"
-	"path/filepath"
 	"reflect"
-	"strconv"
 	"strings"
-	"time"
 )
 
 const (
-	KindDeployment    = "deployment"
-	KindStatefulSet   = "statefulset"
-	ActionAdd         = "add"
-	ActionDelete      = "delete"
-	ErrorKubeConfig   = "Error getting Kubernetes config "
-	ErrorInvalidInput = "Invalid input "
-	ErrorDynamic      = "Error getting dynamic client "
-	ErrorUpdate       = "Error updating resource "
-	ErrorGet          = "Error getting resource "
-	ErrorList         = "Error listing resources "
-	ErrorTimeout      = "Timeout while updating the instrumentation status: "
+	KindDeployment           = "deployment"
+	KindStatefulSet          = "statefulset"
+	ActionAdd                = "add"
+	ActionDelete             = "delete"
+	ErrorKubeConfig          = "Error getting Kubernetes config "
+	ErrorInvalidInput        = "Invalid input "
+	ErrorDynamic             = "Error getting dynamic client "
+	ErrorUpdate              = "Error updating resource "
+	ErrorGet                 = "Error getting resource "
+	ErrorList                = "Error listing resources "
+	ErrorTimeout             = "Timeout while updating the instrumentation status: "
+	ErrorShutdown            = "Server is shutting down, instrumentation status update was interrupted: "
+	ErrorRollout             = "Timeout while waiting for the rollout: "
+	ErrorWorkloadChanged     = "The workload changed since the operation: "
+	ErrorOperation           = "Operation can't be reverted: "
+	ErrorInProgress          = "Another operation is in progress on the workload: "
+	ErrorIdempotencyKey      = "Idempotency key reused with a different request: "
+	ErrorStateChanged        = "The instrumentation state changed since it was read: "
+	ErrorNotInstrumentable   = "The container can't be instrumented: "
+	ErrorServiceNameConflict = "The service name is used by other workloads: "
+	ErrorNoReadyPod          = "No ready pod of the workload runs the container: "
+
+	LogTypeAnnotation         = "logz.io/application_type"
+	InstrumentationAnnotation = "logz.io/traces_instrument"
+	ServiceNameAnnotation     = "logz.io/service-name"
+	InstrumentValue           = "true"
+	RollbackValue             = "rollback"
+	// AnnotationPrefix is the prefix of the pod template annotations read by the instrumentor
+	AnnotationPrefix = "logz.io/"
+	// ActorHeader identifies the user who sent a request, it is recorded in the operations the request starts
+	ActorHeader = "X-User"
+	// IdempotencyKeyHeader makes the repeats of a request replay the response of the first one instead of running again
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on the responses replayed for a repeated idempotency key
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	// RetryAfterHeader is set on the responses of requests that didn't run and can be retried, they aren't stored for their idempotency key
+	RetryAfterHeader = "Retry-After"
 
 	ResourceGroup                   = "logz.io"
 	ResourceVersion                 = "v1alpha1"
@@ -35,36 +58,35 @@ const (
 var (
 	ValidKinds   = []string{KindDeployment, KindStatefulSet}
 	ValidActions = []string{ActionAdd, ActionDelete}
+
+	// InstrumentedApplicationGVR is the instrumented application crd scheme
+	InstrumentedApplicationGVR = schema.GroupVersionResource{
+		Group:    ResourceGroup,
+		Version:  ResourceVersion,
+		Resource: ResourceInstrumentedApplication,
+	}
 )
 
 // InitLogger initializes the logger
-func InitLogger() zap.SugaredLogger {
-	config := zap.NewProductionConfig()
-	config.OutputPaths = []string{"stdout"} // write to stdout
-	config.InitialFields = map[string]interface{}{}
-	logger, configErr := config.Build()
+func InitLogger(cfg *config.Config) *zap.SugaredLogger {
+	var loggerConfig zap.Config
+	if cfg.LogFormat == config.LogFormatConsole {
+		loggerConfig = zap.NewDevelopmentConfig()
+	} else {
+		loggerConfig = zap.NewProductionConfig()
+	}
+	level, levelErr := zap.ParseAtomicLevel(cfg.LogLevel)
+	if levelErr == nil {
+		loggerConfig.Level = level
+	}
+	loggerConfig.OutputPaths = []string{"stdout"} // write to stdout
+	loggerConfig.InitialFields = map[string]interface{}{}
+	logger, configErr := loggerConfig.Build()
 	if configErr != nil {
 		fmt.Printf("Error while initializing the logger: %v", configErr)
 		panic(configErr)
 	}
-	return *logger.Sugar()
-}
-
-// GetTimeout returns the timeout for the request in time.Duration in seconds
-func GetTimeout() (time.Duration, error) {
-	var timeoutSeconds int
-	var err error
-	timeoutStr := os.Getenv("REQUEST_TIMEOUT_SECONDS")
-	if timeoutStr == "" {
-		// Default timeout is 90 seconds
-		timeoutSeconds = 90
-	} else {
-		timeoutSeconds, err = strconv.Atoi(timeoutStr)
-		if err != nil {
-			return time.Duration(0), err
-		}
-	}
-	return time.Duration(timeoutSeconds) * time.Second, nil
+	return logger.Sugar()
 }
 
 // DeepEqualMap compares two maps
@@ -80,26 +102,51 @@ func DeepEqualMap(a, b map[string]interface{}) bool {
 	return true
 }
 
-// GetConfig returns a Kubernetes config
-func GetConfig() (*rest.Config, error) {
-	var config *rest.Config
-
-	kubeconfig := filepath.Join(homedir.HomeDir(), ".kube", "config")
-	if _, err := os.Stat(kubeconfig); err == nil {
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+// GetConfig returns a Kubernetes config.
+// The in-cluster config is used if it is preferred or if no kubeconfig file can be found.
+func GetConfig(cfg *config.Config) (*rest.Config, error) {
+	var restConfig *rest.Config
+	var err error
+	if cfg.InCluster {
+		restConfig, err = rest.InClusterConfig()
 		if err != nil {
-			return nil, err
+			restConfig, err = kubeconfigConfig(cfg)
 		}
 	} else {
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			return nil, err
+		restConfig, err = kubeconfigConfig(cfg)
+		if clientcmd.IsEmptyConfig(err) {
+			restConfig, err = rest.InClusterConfig()
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
+	restConfig.QPS = cfg.KubeClientQPS
+	restConfig.Burst = cfg.KubeClientBurst
+	return restConfig, nil
+}
 
-	return config, nil
+// kubeconfigConfig loads the configured kubeconfig file and context, following the default loading rules ($KUBECONFIG, ~/.kube/config) if no file is set
+func kubeconfigConfig(cfg *config.Config) (*rest.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if cfg.Kubeconfig != "" {
+		loadingRules.ExplicitPath = cfg.Kubeconfig
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: cfg.KubeContext}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
 }
 
 func IsInternalResource(name string) bool {
 	return strings.Contains(name, "easy-connect") || strings.Contains(name, "ezkonnect") || (name == "kubernetes-instrumentor")
 }
+
+// LogzioAnnotations returns a copy of the logz.io annotations of a pod template
+func LogzioAnnotations(annotations map[string]string) map[string]string {
+	logzio := map[string]string{}
+	for key, value := range annotations {
+		if strings.HasPrefix(key, AnnotationPrefix) {
+			logzio[key] = value
+		}
+	}
+	return logzio
+}
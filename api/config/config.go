@@ -0,0 +1,299 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+)
+
+const (
+	LogFormatJSON    = "json"
+	LogFormatConsole = "console"
+
+	// ConflictWarn and ConflictReject are the policies for service names already used by other workloads
+	ConflictWarn   = "warn"
+	ConflictReject = "reject"
+
+	// configFileFlag and configFileEnv point to an optional YAML file with the server configuration
+	configFileFlag = "config"
+	configFileEnv  = "CONFIG_FILE"
+)
+
+var (
+	ValidLogLevels  = []string{"debug", "info", "warn", "error"}
+	ValidLogFormats = []string{LogFormatJSON, LogFormatConsole}
+	// ValidConflictPolicies are the values of service_name_conflicts
+	ValidConflictPolicies = []string{ConflictWarn, ConflictReject}
+)
+
+// Config is the effective server configuration
+// listen_address: the address the http server listens on
+// kubeconfig: path to a kubeconfig file, the default loading rules ($KUBECONFIG, ~/.kube/config) are used if empty
+// kube_context: the kubeconfig context to use, the current context is used if empty
+// in_cluster: prefer the in-cluster config over a kubeconfig file
+// kube_client_qps: queries per second allowed for the kubernetes clients
+// kube_client_burst: burst allowed for the kubernetes clients
+// request_timeout_seconds: how long an annotate request waits for the instrumentation status to update
+// shutdown_grace_period_seconds: how long in-flight requests are given to complete on shutdown
+// log_level: one of debug, info, warn, error
+// log_format: json or console
+// cors_allowed_origins: origins allowed to call the api from a browser, "*" allows any origin
+// log_types_configmap: the ConfigMap, as namespace/name, whose keys are log types accepted besides the built-in ones
+// service_name_conflicts: whether a service name already used by another workload is rejected or accepted with a warning
+// demo: serve workloads and InstrumentedApplication resources from the demo fixture files instead of a cluster
+// demo_fixtures: YAML files with the deployments, statefulsets and InstrumentedApplication resources served in demo mode
+// demo_instrumentor_delay_seconds: how long the simulated instrumentor takes for every update in demo mode
+type Config struct {
+	ListenAddress                string   `json:"listen_address"`
+	Kubeconfig                   string   `json:"kubeconfig"`
+	KubeContext                  string   `json:"kube_context"`
+	InCluster                    bool     `json:"in_cluster"`
+	KubeClientQPS                float32  `json:"kube_client_qps"`
+	KubeClientBurst              int      `json:"kube_client_burst"`
+	RequestTimeoutSeconds        int      `json:"request_timeout_seconds"`
+	ShutdownGracePeriodSeconds   int      `json:"shutdown_grace_period_seconds"`
+	LogLevel                     string   `json:"log_level"`
+	LogFormat                    string   `json:"log_format"`
+	CORSAllowedOrigins           []string `json:"cors_allowed_origins"`
+	ServiceNameConflicts         string   `json:"service_name_conflicts"`
+	LogTypesConfigMap            string   `json:"log_types_configmap"`
+	Demo                         bool     `json:"demo"`
+	DemoFixtures                 []string `json:"demo_fixtures"`
+	DemoInstrumentorDelaySeconds int      `json:"demo_instrumentor_delay_seconds"`
+}
+
+// setting describes a configuration field that can be set from a flag and an env var
+type setting struct {
+	flag   string
+	env    string
+	usage  string
+	isBool bool
+	set    func(cfg *Config, value string) error
+}
+
+var settings = []setting{
+	stringSetting("listen-address", "LISTEN_ADDRESS", "address the http server listens on", func(cfg *Config) *string { return &cfg.ListenAddress }),
+	stringSetting("kubeconfig", "KUBECONFIG_PATH", "path to a kubeconfig file, the default loading rules ($KUBECONFIG, ~/.kube/config) are used if empty", func(cfg *Config) *string { return &cfg.Kubeconfig }),
+	stringSetting("kube-context", "KUBE_CONTEXT", "kubeconfig context to use", func(cfg *Config) *string { return &cfg.KubeContext }),
+	boolSetting("in-cluster", "IN_CLUSTER", "prefer the in-cluster config over a kubeconfig file", func(cfg *Config) *bool { return &cfg.InCluster }),
+	{flag: "kube-client-qps", env: "KUBE_CLIENT_QPS", usage: "queries per second allowed for the kubernetes clients", set: func(cfg *Config, value string) error {
+		qps, err := strconv.ParseFloat(value, 32)
+		cfg.KubeClientQPS = float32(qps)
+		return err
+	}},
+	intSetting("kube-client-burst", "KUBE_CLIENT_BURST", "burst allowed for the kubernetes clients", func(cfg *Config) *int { return &cfg.KubeClientBurst }),
+	intSetting("request-timeout-seconds", "REQUEST_TIMEOUT_SECONDS", "how long an annotate request waits for the instrumentation status to update", func(cfg *Config) *int { return &cfg.RequestTimeoutSeconds }),
+	intSetting("shutdown-grace-period-seconds", "SHUTDOWN_GRACE_PERIOD_SECONDS", "how long in-flight requests are given to complete on shutdown", func(cfg *Config) *int { return &cfg.ShutdownGracePeriodSeconds }),
+	stringSetting("log-level", "LOG_LEVEL", "one of debug, info, warn, error", func(cfg *Config) *string { return &cfg.LogLevel }),
+	stringSetting("log-format", "LOG_FORMAT", "json or console", func(cfg *Config) *string { return &cfg.LogFormat }),
+	listSetting("cors-allowed-origins", "CORS_ALLOWED_ORIGINS", "comma separated origins allowed to call the api from a browser", func(cfg *Config) *[]string { return &cfg.CORSAllowedOrigins }),
+	stringSetting("service-name-conflicts", "SERVICE_NAME_CONFLICTS", "warn or reject, for service names already used by other workloads", func(cfg *Config) *string { return &cfg.ServiceNameConflicts }),
+	stringSetting("log-types-configmap", "LOG_TYPES_CONFIGMAP", "namespace/name of the ConfigMap whose keys are log types accepted besides the built-in ones, empty for the built-in log types only", func(cfg *Config) *string { return &cfg.LogTypesConfigMap }),
+	boolSetting("demo", "DEMO", "serve the demo fixture files instead of a cluster", func(cfg *Config) *bool { return &cfg.Demo }),
+	listSetting("demo-fixtures", "DEMO_FIXTURES", "comma separated YAML files served in demo mode", func(cfg *Config) *[]string { return &cfg.DemoFixtures }),
+	intSetting("demo-instrumentor-delay-seconds", "DEMO_INSTRUMENTOR_DELAY_SECONDS", "how long the simulated instrumentor takes for every update in demo mode", func(cfg *Config) *int { return &cfg.DemoInstrumentorDelaySeconds }),
+}
+
+func stringSetting(flag, env, usage string, field func(*Config) *string) setting {
+	return setting{flag: flag, env: env, usage: usage, set: func(cfg *Config, value string) error {
+		*field(cfg) = value
+		return nil
+	}}
+}
+
+func intSetting(flag, env, usage string, field func(*Config) *int) setting {
+	return setting{flag: flag, env: env, usage: usage, set: func(cfg *Config, value string) error {
+		parsed, err := strconv.Atoi(value)
+		*field(cfg) = parsed
+		return err
+	}}
+}
+
+func boolSetting(flag, env, usage string, field func(*Config) *bool) setting {
+	return setting{flag: flag, env: env, usage: usage, isBool: true, set: func(cfg *Config, value string) error {
+		parsed, err := strconv.ParseBool(value)
+		*field(cfg) = parsed
+		return err
+	}}
+}
+
+// listSetting parses a comma separated list
+func listSetting(flag, env, usage string, field func(*Config) *[]string) setting {
+	return setting{flag: flag, env: env, usage: usage, set: func(cfg *Config, value string) error {
+		*field(cfg) = splitList(value)
+		return nil
+	}}
+}
+
+// flagValue records the raw value of a flag, so flags can be applied after the config file and env vars
+type flagValue struct {
+	name   string
+	isBool bool
+	values map[string]string
+}
+
+func (f *flagValue) String() string {
+	return f.values[f.name]
+}
+
+func (f *flagValue) Set(value string) error {
+	f.values[f.name] = value
+	return nil
+}
+
+// IsBoolFlag lets boolean flags be set without a value, e.g. --demo
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		ListenAddress:                ":5050",
+		KubeClientQPS:                20,
+		KubeClientBurst:              40,
+		RequestTimeoutSeconds:        90,
+		ShutdownGracePeriodSeconds:   30,
+		LogLevel:                     "info",
+		LogFormat:                    LogFormatJSON,
+		ServiceNameConflicts:         ConflictWarn,
+		LogTypesConfigMap:            "default/easy-connect-log-types",
+		DemoFixtures:                 []string{"test/demoServices.yaml", "test/demoInstrumentedApplications.yaml"},
+		DemoInstrumentorDelaySeconds: 2,
+	}
+}
+
+// Load builds the configuration from the defaults, an optional YAML file, env vars and command line flags.
+// Later sources take precedence: flags override env vars, which override the file.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("easy-connect-server", flag.ContinueOnError)
+	configFile := fs.String(configFileFlag, "", "path to a YAML configuration file (env: "+configFileEnv+")")
+	flagValues := map[string]string{}
+	for _, s := range settings {
+		fs.Var(&flagValue{name: s.flag, isBool: s.isBool, values: flagValues}, s.flag, s.usage+" (env: "+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	path := *configFile
+	if path == "" {
+		path = getenv(configFileEnv)
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			if err := s.set(cfg, value); err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s: %w", value, s.env, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if value, ok := flagValues[s.flag]; ok {
+			if err := s.set(cfg, value); err != nil {
+				return nil, fmt.Errorf("invalid value %q for --%s: %w", value, s.flag, err)
+			}
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile overrides the configuration with the fields set in a YAML file
+func (c *Config) loadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	if err = yaml.UnmarshalStrict(content, c); err != nil {
+		return fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate returns an error describing every invalid field of the configuration
+func (c *Config) Validate() error {
+	var problems []string
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		problems = append(problems, fmt.Sprintf("listen_address: %v", err))
+	}
+	if c.KubeClientQPS <= 0 {
+		problems = append(problems, "kube_client_qps: must be positive")
+	}
+	if c.KubeClientBurst <= 0 {
+		problems = append(problems, "kube_client_burst: must be positive")
+	}
+	if c.RequestTimeoutSeconds <= 0 {
+		problems = append(problems, "request_timeout_seconds: must be positive")
+	}
+	if c.ShutdownGracePeriodSeconds < 0 {
+		problems = append(problems, "shutdown_grace_period_seconds: must not be negative")
+	}
+	if !Contains(ValidLogLevels, c.LogLevel) {
+		problems = append(problems, fmt.Sprintf("log_level: must be one of %s", strings.Join(ValidLogLevels, ", ")))
+	}
+	if !Contains(ValidLogFormats, c.LogFormat) {
+		problems = append(problems, fmt.Sprintf("log_format: must be one of %s", strings.Join(ValidLogFormats, ", ")))
+	}
+	for _, origin := range c.CORSAllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			problems = append(problems, fmt.Sprintf("cors_allowed_origins: %q is not an origin (scheme://host[:port])", origin))
+		}
+	}
+	if !Contains(ValidConflictPolicies, c.ServiceNameConflicts) {
+		problems = append(problems, fmt.Sprintf("service_name_conflicts: must be one of %s", strings.Join(ValidConflictPolicies, ", ")))
+	}
+	if c.LogTypesConfigMap != "" {
+		namespace, name, ok := strings.Cut(c.LogTypesConfigMap, "/")
+		if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+			problems = append(problems, fmt.Sprintf("log_types_configmap: %q is not namespace/name", c.LogTypesConfigMap))
+		}
+	}
+	if c.DemoInstrumentorDelaySeconds < 0 {
+		problems = append(problems, "demo_instrumentor_delay_seconds: must not be negative")
+	}
+	if c.Demo && len(c.DemoFixtures) == 0 {
+		problems = append(problems, "demo_fixtures: at least one file is required in demo mode")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Contains reports whether list has value
+func Contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func envFrom(values map[string]string) func(string) string {
+	return func(name string) string {
+		return values[name]
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load(nil, envFrom(nil))
+	require.NoError(t, err)
+	assert.Equal(t, Default(), cfg)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "listen_address: \":7000\"\nlog_level: debug\nkube_client_burst: 10\nrequest_timeout_seconds: 30\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	env := envFrom(map[string]string{
+		"CONFIG_FILE":             path,
+		"LISTEN_ADDRESS":          ":8080",
+		"REQUEST_TIMEOUT_SECONDS": "60",
+		"CORS_ALLOWED_ORIGINS":    "https://app.logz.io, http://localhost:3000",
+	})
+	cfg, err := Load([]string{"--listen-address", ":9090", "--kube-context", "staging"}, env)
+	require.NoError(t, err)
+
+	// flags override env, env overrides the file, the file overrides the defaults
+	assert.Equal(t, ":9090", cfg.ListenAddress)
+	assert.Equal(t, "staging", cfg.KubeContext)
+	assert.Equal(t, 60, cfg.RequestTimeoutSeconds)
+	assert.Equal(t, "debug", cfg.LogLevel)
+	assert.Equal(t, 10, cfg.KubeClientBurst)
+	assert.Equal(t, []string{"https://app.logz.io", "http://localhost:3000"}, cfg.CORSAllowedOrigins)
+}
+
+func TestLoadBoolFlag(t *testing.T) {
+	cfg, err := Load([]string{"--demo", "--in-cluster=false"}, envFrom(map[string]string{"IN_CLUSTER": "true"}))
+	require.NoError(t, err)
+	assert.True(t, cfg.Demo)
+	assert.False(t, cfg.InCluster)
+}
+
+func TestLoadKubeconfig(t *testing.T) {
+	// KUBECONFIG is a list of files read by the default loading rules, only KUBECONFIG_PATH sets the explicit file
+	cfg, err := Load(nil, envFrom(map[string]string{"KUBECONFIG": "/a:/b"}))
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Kubeconfig)
+
+	cfg, err = Load(nil, envFrom(map[string]string{"KUBECONFIG_PATH": "/a"}))
+	require.NoError(t, err)
+	assert.Equal(t, "/a", cfg.Kubeconfig)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	_, err := Load([]string{"--request-timeout-seconds", "soon"}, envFrom(nil))
+	assert.Error(t, err)
+
+	_, err = Load(nil, envFrom(map[string]string{
+		"LOG_LEVEL":              "verbose",
+		"LISTEN_ADDRESS":         "5050",
+		"CORS_ALLOWED_ORIGINS":   "logz.io",
+		"SERVICE_NAME_CONFLICTS": "ignore",
+		"LOG_TYPES_CONFIGMAP":    "easy-connect-log-types",
+	}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "log_level")
+	assert.Contains(t, err.Error(), "listen_address")
+	assert.Contains(t, err.Error(), "cors_allowed_origins")
+	assert.Contains(t, err.Error(), "service_name_conflicts")
+	assert.Contains(t, err.Error(), "log_types_configmap")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("listen_adress: \":7000\"\n"), 0o600))
+	_, err = Load([]string{"--config", path}, envFrom(nil))
+	assert.Error(t, err, "unknown fields in the config file should be rejected")
+}
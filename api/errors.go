@@ -0,0 +1,171 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"runtime/debug"
+)
+
+// Machine-readable error codes of the api
+const (
+	CodeInvalidInput     = "invalid_input"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeNotFound         = "not_found"
+	CodeForbidden        = "forbidden"
+	CodeConflict         = "conflict"
+	CodeUnprocessable    = "unprocessable"
+	CodeTimeout          = "timeout"
+	CodeShuttingDown     = "shutting_down"
+	CodeInternal         = "internal"
+
+	RequestIDHeader = "X-Request-ID"
+)
+
+type requestIDKey struct{}
+
+// Error is the JSON body of every error response
+// error: a human readable message
+// code: a machine-readable error code
+// details: additional information about the error, e.g. the kubernetes resource that was not found
+// request_id: the id of the request, also returned in the X-Request-ID header
+type Error struct {
+	Status    int         `json:"-"`
+	Message   string      `json:"error"`
+	Code      string      `json:"code"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// NewError creates an Error with the given http status, code and message
+func NewError(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+// WithDetails returns the error with details attached
+func (e *Error) WithDetails(details interface{}) *Error {
+	e.Details = details
+	return e
+}
+
+// KubernetesErrorDetails describes the kubernetes resource an error refers to
+type KubernetesErrorDetails struct {
+	Reason string           `json:"reason,omitempty"`
+	Kind   string           `json:"kind,omitempty"`
+	Name   string           `json:"name,omitempty"`
+	Causes []v1.StatusCause `json:"causes,omitempty"`
+}
+
+// FromKubernetesError maps an error returned by the kubernetes api to an Error, prefixing its message with message.
+// NotFound, Forbidden, Conflict, Invalid and timeout reasons keep their meaning, anything else is an internal error.
+func FromKubernetesError(message string, err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return NewError(http.StatusGatewayTimeout, CodeTimeout, message+err.Error())
+	}
+	var statusErr apierrors.APIStatus
+	if !errors.As(err, &statusErr) {
+		return NewError(http.StatusInternalServerError, CodeInternal, message+err.Error())
+	}
+	status := statusErr.Status()
+	var e *Error
+	switch {
+	case apierrors.IsNotFound(err):
+		e = NewError(http.StatusNotFound, CodeNotFound, message+err.Error())
+	case apierrors.IsForbidden(err), apierrors.IsUnauthorized(err):
+		e = NewError(http.StatusForbidden, CodeForbidden, message+err.Error())
+	case apierrors.IsConflict(err), apierrors.IsAlreadyExists(err):
+		e = NewError(http.StatusConflict, CodeConflict, message+err.Error())
+	case apierrors.IsInvalid(err), apierrors.IsBadRequest(err):
+		e = NewError(http.StatusUnprocessableEntity, CodeUnprocessable, message+err.Error())
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err):
+		e = NewError(http.StatusGatewayTimeout, CodeTimeout, message+err.Error())
+	default:
+		e = NewError(http.StatusInternalServerError, CodeInternal, message+err.Error())
+	}
+	details := KubernetesErrorDetails{Reason: string(status.Reason)}
+	if status.Details != nil {
+		details.Kind = status.Details.Kind
+		details.Name = status.Details.Name
+		details.Causes = status.Details.Causes
+	}
+	return e.WithDetails(details)
+}
+
+// WriteError writes err as a JSON error response, tagged with the id of the request
+func WriteError(w http.ResponseWriter, r *http.Request, err *Error) {
+	err.RequestID = RequestIDFrom(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.Status)
+	json.NewEncoder(w).Encode(err)
+}
+
+// RequestID tags every request with an id, taken from the X-Request-ID header or generated, and returns it in the response
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID)))
+	})
+}
+
+// RequestIDFrom returns the id of the request the context belongs to
+func RequestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Recover turns a panic in a handler into an internal error response instead of a dropped connection
+func Recover(logger *zap.SugaredLogger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					if recovered == http.ErrAbortHandler {
+						panic(recovered)
+					}
+					logger.Errorw("Panic while handling request", "panic", recovered, "request_id", RequestIDFrom(r.Context()), "stack", string(debug.Stack()))
+					WriteError(w, r, NewError(http.StatusInternalServerError, CodeInternal, fmt.Sprintf("Internal error: %v", recovered)))
+				}
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NotFoundHandler answers requests for unknown paths with a JSON error
+func NotFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, r, NewError(http.StatusNotFound, CodeNotFound, "Unknown path "+r.URL.Path))
+	})
+}
+
+// MethodNotAllowedHandler answers requests with an unsupported method with a JSON error
+func MethodNotAllowedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, r, NewError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Invalid request method"))
+	})
+}
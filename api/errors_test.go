@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFromKubernetesError(t *testing.T) {
+	deployments := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	testCases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{apierrors.NewNotFound(deployments, "adservice"), http.StatusNotFound, CodeNotFound},
+		{apierrors.NewForbidden(deployments, "adservice", errors.New("rbac")), http.StatusForbidden, CodeForbidden},
+		{apierrors.NewConflict(deployments, "adservice", errors.New("modified")), http.StatusConflict, CodeConflict},
+		{apierrors.NewInvalid(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "adservice", field.ErrorList{field.Required(field.NewPath("spec"), "")}), http.StatusUnprocessableEntity, CodeUnprocessable},
+		{apierrors.NewTimeoutError("slow", 1), http.StatusGatewayTimeout, CodeTimeout},
+		{fmt.Errorf("waiting: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, CodeTimeout},
+		{apierrors.NewInternalError(errors.New("etcd")), http.StatusInternalServerError, CodeInternal},
+		{errors.New("connection refused"), http.StatusInternalServerError, CodeInternal},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			apiErr := FromKubernetesError(ErrorGet, tc.err)
+			assert.Equal(t, tc.status, apiErr.Status)
+			assert.Equal(t, tc.code, apiErr.Code)
+			assert.Equal(t, ErrorGet+tc.err.Error(), apiErr.Message)
+		})
+	}
+	notFound := FromKubernetesError(ErrorGet, apierrors.NewNotFound(deployments, "adservice"))
+	assert.Equal(t, KubernetesErrorDetails{Reason: "NotFound", Kind: "deployments", Name: "adservice"}, notFound.Details)
+}
+
+func TestWriteError(t *testing.T) {
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, r, NewError(http.StatusConflict, CodeConflict, "busy"))
+	}))
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set(RequestIDHeader, "abc")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Equal(t, "abc", recorder.Header().Get(RequestIDHeader))
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Equal(t, map[string]interface{}{"error": "busy", "code": CodeConflict, "request_id": "abc"}, body)
+}
@@ -0,0 +1,304 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/operations"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sources of history entries
+const (
+	SourceOperation          = "easy-connect"
+	SourceReplicaSet         = "replicaset"
+	SourceControllerRevision = "controllerrevision"
+)
+
+// revisionAnnotation is the annotation the deployment controller sets on the ReplicaSets of a deployment
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
+// WorkloadHistory is the timeline of the changes of a workload's logz.io pod template annotations
+// namespace, kind, name: the workload
+// entries: the changes, oldest first
+type WorkloadHistory struct {
+	Namespace string  `json:"namespace"`
+	Kind      string  `json:"kind"`
+	Name      string  `json:"name"`
+	Entries   []Entry `json:"entries"`
+}
+
+// Entry is a change of the logz.io annotations of the workload's pod template
+// time: when the operation started, or when the ReplicaSet or ControllerRevision of the change was created
+// source: easy-connect for operations of the server, replicaset or controllerrevision for changes made outside easy-connect
+// operation_id, type, actor, status, rollback_reason: the operation, only for the easy-connect source
+// revision: the revision of the workload, only for the replicaset and controllerrevision sources
+// changes: the annotations the change added, modified or removed
+// annotations: the logz.io annotations after the change
+type Entry struct {
+	Time           time.Time         `json:"time"`
+	Source         string            `json:"source"`
+	OperationID    string            `json:"operation_id,omitempty"`
+	Type           string            `json:"type,omitempty"`
+	Actor          string            `json:"actor,omitempty"`
+	Status         string            `json:"status,omitempty"`
+	RollbackReason string            `json:"rollback_reason,omitempty"`
+	Revision       int64             `json:"revision,omitempty"`
+	Changes        []Change          `json:"changes"`
+	Annotations    map[string]string `json:"annotations"`
+}
+
+// Change is the change of a single annotation
+// annotation: the annotation key, e.g. logz.io/service-name
+// from: the value before the change, omitted if the annotation was added
+// to: the value after the change, omitted if the annotation was removed
+type Change struct {
+	Annotation string  `json:"annotation"`
+	From       *string `json:"from,omitempty"`
+	To         *string `json:"to,omitempty"`
+}
+
+// revision is a pod template revision of a workload
+type revision struct {
+	number      int64
+	created     time.Time
+	annotations map[string]string
+}
+
+// Handler serves the workload history endpoint
+type Handler struct {
+	app *api.App
+}
+
+// NewHandler creates a history Handler that uses the app's clients and operations
+func NewHandler(app *api.App) *Handler {
+	return &Handler{app: app}
+}
+
+// GetWorkloadHistory returns the history of a workload built from the server's operations and the workload's
+// ReplicaSets or ControllerRevisions, so changes made outside easy-connect are included
+func (h *Handler) GetWorkloadHistory(w http.ResponseWriter, r *http.Request) {
+	logger := h.app.Logger
+	vars := mux.Vars(r)
+	namespace, kind, name := vars["namespace"], strings.ToLower(vars["kind"]), vars["name"]
+	var source string
+	var revisions []revision
+	var err error
+	switch kind {
+	case api.KindDeployment:
+		source = SourceReplicaSet
+		revisions, err = deploymentRevisions(r.Context(), h.app, namespace, name)
+	case api.KindStatefulSet:
+		source = SourceControllerRevision
+		revisions, err = statefulSetRevisions(r.Context(), h.app, namespace, name)
+	default:
+		api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+"kind must be one of "+strings.Join(api.ValidKinds, ", ")))
+		return
+	}
+	if err != nil {
+		if api.RequestCancelled(r, logger, "list "+kind+" revisions") {
+			return
+		}
+		logger.Error(api.ErrorList, zap.Error(err))
+		api.WriteError(w, r, api.FromKubernetesError(api.ErrorList, err))
+		return
+	}
+	history := WorkloadHistory{
+		Namespace: namespace,
+		Kind:      kind,
+		Name:      name,
+		Entries:   buildEntries(h.app.Operations.List(operations.Workload{Namespace: namespace, Kind: kind, Name: name}), revisions, source),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(history)
+}
+
+// buildEntries merges the operations and the revisions of a workload into a timeline.
+// A revision change with the same annotations before and after as an operation is attributed to the operation, the others are
+// reported as changes made outside easy-connect.
+func buildEntries(ops []operations.Operation, revisions []revision, source string) []Entry {
+	entries := []Entry{}
+	attributed := map[string]bool{}
+	for _, operation := range ops {
+		entries = append(entries, Entry{
+			Time:           operation.StartedAt,
+			Source:         SourceOperation,
+			OperationID:    operation.ID,
+			Type:           operation.Type,
+			Actor:          operation.Actor,
+			Status:         operation.Status,
+			RollbackReason: operation.RollbackReason,
+			Changes:        diff(operation.PreviousAnnotations, operation.Annotations),
+			Annotations:    operation.Annotations,
+		})
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].number < revisions[j].number })
+	previous := map[string]string{}
+	for _, rev := range revisions {
+		changes := diff(previous, rev.annotations)
+		from := previous
+		previous = rev.annotations
+		if len(changes) == 0 {
+			continue
+		}
+		if key, ok := findOperation(ops, from, rev.annotations, attributed); ok {
+			attributed[key] = true
+			continue
+		}
+		entries = append(entries, Entry{
+			Time:        rev.created,
+			Source:      source,
+			Revision:    rev.number,
+			Changes:     changes,
+			Annotations: rev.annotations,
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries
+}
+
+// findOperation returns the key of the first operation not attributed yet that changed the annotations from before to after.
+// The automatic rollback of an operation restored its previous annotations, so it is attributed to the operation too.
+func findOperation(ops []operations.Operation, before, after map[string]string, attributed map[string]bool) (string, bool) {
+	for _, operation := range ops {
+		if operation.Annotations == nil {
+			continue
+		}
+		if !attributed[operation.ID] && equalAnnotations(operation.PreviousAnnotations, before) && equalAnnotations(operation.Annotations, after) {
+			return operation.ID, true
+		}
+		rollbackKey := operation.ID + "/rollback"
+		if operation.Status == operations.StatusRolledBack && !attributed[rollbackKey] &&
+			equalAnnotations(operation.Annotations, before) && equalAnnotations(operation.PreviousAnnotations, after) {
+			return rollbackKey, true
+		}
+	}
+	return "", false
+}
+
+// diff returns the changes from the annotations before to the annotations after, sorted by annotation
+func diff(before, after map[string]string) []Change {
+	changes := []Change{}
+	for key, value := range after {
+		if previous, ok := before[key]; !ok || previous != value {
+			change := Change{Annotation: key, To: stringPointer(value)}
+			if ok {
+				change.From = stringPointer(previous)
+			}
+			changes = append(changes, change)
+		}
+	}
+	for key, value := range before {
+		if _, ok := after[key]; !ok {
+			changes = append(changes, Change{Annotation: key, From: stringPointer(value)})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Annotation < changes[j].Annotation })
+	return changes
+}
+
+// equalAnnotations compares annotations, treating nil and empty maps as equal
+func equalAnnotations(a, b map[string]string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func stringPointer(value string) *string {
+	return &value
+}
+
+// deploymentRevisions returns the revisions of a deployment from the ReplicaSets it owns
+func deploymentRevisions(ctx context.Context, app *api.App, namespace, name string) ([]revision, error) {
+	deployment, err := app.Clientset.AppsV1().Deployments(namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	selector, err := v1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	replicaSets, err := app.Clientset.AppsV1().ReplicaSets(namespace).List(ctx, v1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	var revisions []revision
+	for _, replicaSet := range replicaSets.Items {
+		if !ownedBy(replicaSet.OwnerReferences, "Deployment", name) {
+			continue
+		}
+		number, err := strconv.ParseInt(replicaSet.Annotations[revisionAnnotation], 10, 64)
+		if err != nil {
+			continue
+		}
+		revisions = append(revisions, revision{
+			number:      number,
+			created:     replicaSet.CreationTimestamp.Time,
+			annotations: api.LogzioAnnotations(replicaSet.Spec.Template.Annotations),
+		})
+	}
+	return revisions, nil
+}
+
+// statefulSetRevisions returns the revisions of a statefulset from the ControllerRevisions it owns
+func statefulSetRevisions(ctx context.Context, app *api.App, namespace, name string) ([]revision, error) {
+	statefulSet, err := app.Clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	selector, err := v1.LabelSelectorAsSelector(statefulSet.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	controllerRevisions, err := app.Clientset.AppsV1().ControllerRevisions(namespace).List(ctx, v1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	var revisions []revision
+	for _, controllerRevision := range controllerRevisions.Items {
+		if !ownedBy(controllerRevision.OwnerReferences, "StatefulSet", name) {
+			continue
+		}
+		// the data of a statefulset revision is a patch of the statefulset that holds its pod template
+		var data struct {
+			Spec struct {
+				Template struct {
+					Metadata struct {
+						Annotations map[string]string `json:"annotations"`
+					} `json:"metadata"`
+				} `json:"template"`
+			} `json:"spec"`
+		}
+		if err := json.Unmarshal(controllerRevision.Data.Raw, &data); err != nil {
+			app.Logger.Warnw("Error decoding a controller revision", "name", controllerRevision.Name, "error", err)
+			continue
+		}
+		revisions = append(revisions, revision{
+			number:      controllerRevision.Revision,
+			created:     controllerRevision.CreationTimestamp.Time,
+			annotations: api.LogzioAnnotations(data.Spec.Template.Metadata.Annotations),
+		})
+	}
+	return revisions, nil
+}
+
+// ownedBy reports whether the owner references include the controller of the given kind and name
+func ownedBy(owners []v1.OwnerReference, kind, name string) bool {
+	for _, owner := range owners {
+		if owner.Kind == kind && owner.Name == name && owner.APIVersion == appsv1.SchemeGroupVersion.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/config"
+	"github.com/logzio/easy-connect-server/api/operations"
+	"github.com/logzio/easy-connect-server/api/simulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+// replicaSet builds the ReplicaSet of a deployment revision with the given pod template annotations
+func replicaSet(deployment *appsv1.Deployment, revision int, annotations map[string]string) *appsv1.ReplicaSet {
+	template := *deployment.Spec.Template.DeepCopy()
+	template.Annotations = annotations
+	return &appsv1.ReplicaSet{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace:         deployment.Namespace,
+			Name:              deployment.Name + "-" + strconv.Itoa(revision),
+			Labels:            template.Labels,
+			Annotations:       map[string]string{simulator.DeploymentRevisionAnnotation: strconv.Itoa(revision)},
+			CreationTimestamp: v1.NewTime(start.Add(time.Duration(revision) * time.Hour)),
+			OwnerReferences:   []v1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: deployment.Name}},
+		},
+		Spec: appsv1.ReplicaSetSpec{Selector: deployment.Spec.Selector, Template: template},
+	}
+}
+
+func getHistory(t *testing.T, app *api.App, kind, name string) WorkloadHistory {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/workloads/default/"+kind+"/"+name+"/history", nil)
+	NewHandler(app).GetWorkloadHistory(recorder, mux.SetURLVars(request, map[string]string{"namespace": "default", "kind": kind, "name": name}))
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var history WorkloadHistory
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &history))
+	return history
+}
+
+func TestGetWorkloadHistory(t *testing.T) {
+	deployment := simulator.Deployment("default", "adservice", "server")
+	logType := map[string]string{api.LogTypeAnnotation: "java"}
+	instrumented := map[string]string{api.LogTypeAnnotation: "java", api.InstrumentationAnnotation: api.InstrumentValue, api.ServiceNameAnnotation: "ads"}
+	objects := []runtime.Object{
+		deployment,
+		replicaSet(deployment, 1, nil),
+		// the log type was set with kubectl
+		replicaSet(deployment, 2, map[string]string{api.LogTypeAnnotation: "java", "kubectl.kubernetes.io/restartedAt": "now"}),
+		// a restart doesn't change the logz.io annotations
+		replicaSet(deployment, 3, logType),
+		// tracing was enabled with easy-connect
+		replicaSet(deployment, 4, instrumented),
+	}
+	app := api.NewAppWithClients(config.Default(), zap.NewNop().Sugar(), simulator.NewClientset(objects...), simulator.NewDynamicClient())
+	operation, err := app.Operations.StartExclusive(context.Background(), operations.Operation{Type: operations.TypeAnnotate, Actor: "jane",
+		Workload: operations.Workload{Namespace: "default", Kind: api.KindDeployment, Name: "adservice"}}, false)
+	require.NoError(t, err)
+	app.Operations.Update(operation.ID, func(op *operations.Operation) {
+		op.PreviousAnnotations, op.Annotations = logType, instrumented
+	})
+	app.Operations.Finish(operation.ID, operations.StatusSucceeded, nil)
+
+	history := getHistory(t, app, api.KindDeployment, "adservice")
+	require.Len(t, history.Entries, 2)
+	external := history.Entries[0]
+	assert.Equal(t, SourceReplicaSet, external.Source)
+	assert.Equal(t, int64(2), external.Revision)
+	assert.Equal(t, []Change{{Annotation: api.LogTypeAnnotation, To: stringPointer("java")}}, external.Changes)
+
+	enabled := history.Entries[1]
+	assert.Equal(t, SourceOperation, enabled.Source)
+	assert.Equal(t, operation.ID, enabled.OperationID)
+	assert.Equal(t, "jane", enabled.Actor)
+	assert.Equal(t, []Change{
+		{Annotation: api.ServiceNameAnnotation, To: stringPointer("ads")},
+		{Annotation: api.InstrumentationAnnotation, To: stringPointer(api.InstrumentValue)},
+	}, enabled.Changes)
+}
+
+func TestGetWorkloadHistoryStatefulSet(t *testing.T) {
+	statefulSet := simulator.StatefulSet("default", "redis-cart", "redis")
+	clientset := simulator.NewClientset(statefulSet)
+	app := api.NewAppWithClients(config.Default(), zap.NewNop().Sugar(), clientset, simulator.NewDynamicClient())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	simulator.NewRolloutController(clientset, app.Logger, 0).Start(ctx)
+
+	updated, err := clientset.AppsV1().StatefulSets("default").Get(ctx, "redis-cart", v1.GetOptions{})
+	require.NoError(t, err)
+	updated.Spec.Template.Annotations = map[string]string{api.LogTypeAnnotation: "redis"}
+	_, err = clientset.AppsV1().StatefulSets("default").Update(ctx, updated, v1.UpdateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		revisions, err := clientset.AppsV1().ControllerRevisions("default").List(ctx, v1.ListOptions{})
+		return err == nil && len(revisions.Items) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	history := getHistory(t, app, api.KindStatefulSet, "redis-cart")
+	require.Len(t, history.Entries, 1)
+	assert.Equal(t, SourceControllerRevision, history.Entries[0].Source)
+	assert.Equal(t, int64(2), history.Entries[0].Revision)
+	assert.Equal(t, map[string]string{api.LogTypeAnnotation: "redis"}, history.Entries[0].Annotations)
+}
+
+func TestBuildEntriesRollback(t *testing.T) {
+	previous := map[string]string{api.LogTypeAnnotation: "java"}
+	instrumented := map[string]string{api.LogTypeAnnotation: "java", api.InstrumentationAnnotation: api.InstrumentValue, api.ServiceNameAnnotation: "ads"}
+	ops := []operations.Operation{{ID: "op1", StartedAt: start, Status: operations.StatusRolledBack, PreviousAnnotations: previous, Annotations: instrumented}}
+	revisions := []revision{
+		{number: 1, created: start.Add(-time.Hour), annotations: previous},
+		{number: 2, created: start, annotations: instrumented},
+		{number: 3, created: start.Add(time.Minute), annotations: previous},
+	}
+	entries := buildEntries(ops, revisions, SourceReplicaSet)
+	require.Len(t, entries, 2, "the change and the rollback are attributed to the operation")
+	assert.Equal(t, SourceReplicaSet, entries[0].Source)
+	assert.Equal(t, int64(1), entries[0].Revision)
+	assert.Equal(t, "op1", entries[1].OperationID)
+}
+
+func TestGetWorkloadHistoryInvalidKind(t *testing.T) {
+	app := api.NewAppWithClients(config.Default(), zap.NewNop().Sugar(), simulator.NewClientset(), simulator.NewDynamicClient())
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/workloads/default/daemonset/agent/history", nil)
+	NewHandler(app).GetWorkloadHistory(recorder, mux.SetURLVars(request, map[string]string{"namespace": "default", "kind": "daemonset", "name": "agent"}))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
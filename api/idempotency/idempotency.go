@@ -0,0 +1,219 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/logzio/easy-connect-server/api"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTTL is how long the outcome of a request is kept by default
+	DefaultTTL = 24 * time.Hour
+	// DefaultLimit is the number of outcomes a Store keeps by default, older outcomes are dropped first
+	DefaultLimit = 1000
+	// maxKeyLength is the longest key accepted
+	maxKeyLength = 255
+)
+
+// entry is the outcome of the first request sent with a key, done is closed once the outcome is stored
+type entry struct {
+	fingerprint string
+	done        chan struct{}
+	completed   bool
+	storedAt    time.Time
+	status      int
+	header      http.Header
+	body        []byte
+}
+
+// Store keeps the outcome of the requests sent with an idempotency key, so repeats of a request replay its outcome instead
+// of running it again
+type Store struct {
+	logger *zap.SugaredLogger
+	ttl    time.Duration
+	limit  int
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	order   []string
+}
+
+// NewStore creates a Store that keeps the outcomes of the last limit requests for ttl
+func NewStore(ttl time.Duration, limit int, logger *zap.SugaredLogger) *Store {
+	return &Store{
+		logger:  logger,
+		ttl:     ttl,
+		limit:   limit,
+		now:     time.Now,
+		entries: map[string]*entry{},
+	}
+}
+
+// Handle wraps a handler so requests sent with the Idempotency-Key header run at most once:
+// the first request with a key runs and its response is stored, a repeat with the same key, method, path, query and body
+// waits for the first request to complete and replays its response, and a repeat with a different request is rejected.
+// Requests without the header are passed through unchanged.
+func (s *Store) Handle(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(api.IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+api.IdempotencyKeyHeader+" must be at most 255 characters"))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+err.Error()))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r, body)
+		for {
+			s.mu.Lock()
+			s.expire()
+			existing, ok := s.entries[key]
+			if !ok {
+				current := &entry{fingerprint: fingerprint, done: make(chan struct{})}
+				s.entries[key] = current
+				s.mu.Unlock()
+				s.run(w, r, key, current, next)
+				return
+			}
+			s.mu.Unlock()
+			if existing.fingerprint != fingerprint {
+				api.WriteError(w, r, api.NewError(http.StatusUnprocessableEntity, api.CodeUnprocessable, api.ErrorIdempotencyKey+key))
+				return
+			}
+			// wait for the first request, it is run again if it completed without a response
+			select {
+			case <-existing.done:
+			case <-r.Context().Done():
+				api.RequestCancelled(r, s.logger, "wait for the request with the same idempotency key")
+				return
+			}
+			s.mu.Lock()
+			completed := existing.completed
+			s.mu.Unlock()
+			if completed {
+				s.logger.Infow("Replaying the response of an idempotent request", "idempotency_key", key, "request_id", api.RequestIDFrom(r.Context()))
+				replay(w, existing)
+				return
+			}
+		}
+	}
+}
+
+// run serves the first request with a key and stores its response. The request isn't cancelled if the client disconnects,
+// so a retry of the client gets the outcome of the change instead of starting it again. A response with a Retry-After header,
+// e.g. for an operation that didn't start because another one was in progress, isn't stored so the retry runs.
+func (s *Store) run(w http.ResponseWriter, r *http.Request, key string, current *entry, next http.HandlerFunc) {
+	recorder := &responseRecorder{ResponseWriter: w}
+	completed := false
+	defer func() {
+		s.mu.Lock()
+		if completed && recorder.status != 0 && w.Header().Get(api.RetryAfterHeader) == "" {
+			current.completed = true
+			current.storedAt = s.now()
+			current.status = recorder.status
+			current.header = w.Header().Clone()
+			current.body = recorder.body.Bytes()
+			s.order = append(s.order, key)
+			if len(s.order) > s.limit {
+				delete(s.entries, s.order[0])
+				s.order = s.order[1:]
+			}
+		} else {
+			// the handler panicked, wrote nothing or asked for a retry, the key can be used again
+			delete(s.entries, key)
+		}
+		close(current.done)
+		s.mu.Unlock()
+	}()
+	next(recorder, r.WithContext(detached{r.Context()}))
+	completed = true
+}
+
+// expire drops the outcomes stored longer than the ttl, s.mu must be held
+func (s *Store) expire() {
+	for len(s.order) > 0 {
+		stored, ok := s.entries[s.order[0]]
+		if ok && s.now().Sub(stored.storedAt) < s.ttl {
+			return
+		}
+		if ok {
+			delete(s.entries, s.order[0])
+		}
+		s.order = s.order[1:]
+	}
+}
+
+// replay writes the stored response, with the id of the current request
+func replay(w http.ResponseWriter, stored *entry) {
+	for name, values := range stored.header {
+		if name == api.RequestIDHeader {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.Header().Set(api.IdempotentReplayedHeader, "true")
+	w.WriteHeader(stored.status)
+	w.Write(stored.body)
+}
+
+// requestFingerprint identifies a request by its method, path, query parameters and body. JSON bodies are compared by value,
+// so the order of their fields and their formatting don't matter, and query parameters are compared regardless of their order.
+func requestFingerprint(r *http.Request, body []byte) string {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err == nil {
+		body, _ = json.Marshal(value)
+	}
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.Path + "?" + r.URL.Query().Encode() + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder writes the response to the client and keeps a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(data)
+	// the client may be gone, the response is still stored for its retries
+	return r.ResponseWriter.Write(data)
+}
+
+// detached is a context with the values of its parent that is never cancelled
+type detached struct {
+	parent context.Context
+}
+
+func (detached) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detached) Done() <-chan struct{}               { return nil }
+func (detached) Err() error                          { return nil }
+func (d detached) Value(key interface{}) interface{} { return d.parent.Value(key) }
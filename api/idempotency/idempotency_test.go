@@ -0,0 +1,179 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler answers with the number of times it ran, after release is closed
+func countingHandler(runs *int32, release <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := io.ReadAll(r.Body)
+		run := atomic.AddInt32(runs, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"run": run, "body": string(body)})
+	}
+}
+
+func send(handler http.HandlerFunc, key, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/annotate", strings.NewReader(body))
+	if key != "" {
+		request.Header.Set(api.IdempotencyKeyHeader, key)
+	}
+	handler(recorder, request)
+	return recorder
+}
+
+func TestHandle(t *testing.T) {
+	var runs int32
+	released := make(chan struct{})
+	close(released)
+	handler := NewStore(DefaultTTL, DefaultLimit, zap.NewNop().Sugar()).Handle(countingHandler(&runs, released))
+
+	first := send(handler, "key-1", `{"name": "adservice", "service_name": "ads"}`)
+	require.Equal(t, http.StatusOK, first.Code)
+	assert.Empty(t, first.Header().Get(api.IdempotentReplayedHeader))
+
+	// the same body with a different field order and formatting is replayed
+	repeat := send(handler, "key-1", `{"service_name":"ads","name":"adservice"}`)
+	require.Equal(t, http.StatusOK, repeat.Code)
+	assert.Equal(t, "true", repeat.Header().Get(api.IdempotentReplayedHeader))
+	assert.Equal(t, "application/json", repeat.Header().Get("Content-Type"))
+	assert.Equal(t, first.Body.String(), repeat.Body.String())
+	assert.Equal(t, int32(1), runs)
+
+	different := send(handler, "key-1", `{"name":"adservice","service_name":"ads-v2"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, different.Code)
+	assert.Contains(t, different.Body.String(), `"code":"`+api.CodeUnprocessable+`"`)
+
+	send(handler, "key-2", `{"name":"adservice","service_name":"ads"}`)
+	send(handler, "", `{"name":"adservice","service_name":"ads"}`)
+	assert.Equal(t, int32(3), runs, "other keys and requests without a key run")
+
+	tooLong := send(handler, strings.Repeat("k", maxKeyLength+1), `{}`)
+	assert.Equal(t, http.StatusBadRequest, tooLong.Code)
+}
+
+func TestHandleQuery(t *testing.T) {
+	var runs int32
+	released := make(chan struct{})
+	close(released)
+	handler := NewStore(DefaultTTL, DefaultLimit, zap.NewNop().Sugar()).Handle(countingHandler(&runs, released))
+	revert := func(query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/operations/1/revert"+query, nil)
+		request.Header.Set(api.IdempotencyKeyHeader, "key")
+		handler(recorder, request)
+		return recorder
+	}
+
+	require.Equal(t, http.StatusOK, revert("?wait_for_turn=true&force=false").Code)
+	assert.Equal(t, "true", revert("?force=false&wait_for_turn=true").Header().Get(api.IdempotentReplayedHeader), "the order of the parameters doesn't matter")
+	assert.Equal(t, http.StatusUnprocessableEntity, revert("?wait_for_turn=true&force=true").Code, "other parameters are a different request")
+	assert.Equal(t, int32(1), runs)
+}
+
+func TestHandleConcurrentRepeat(t *testing.T) {
+	var runs int32
+	release := make(chan struct{})
+	handler := NewStore(DefaultTTL, DefaultLimit, zap.NewNop().Sugar()).Handle(countingHandler(&runs, release))
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 3)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = send(handler, "key", `{"name":"adservice"}`)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), runs, "repeats wait for the first request instead of running")
+	for _, response := range responses {
+		assert.Equal(t, responses[0].Body.String(), response.Body.String())
+	}
+}
+
+func TestHandleClientDisconnect(t *testing.T) {
+	var runs int32
+	released := make(chan struct{})
+	close(released)
+	store := NewStore(DefaultTTL, DefaultLimit, zap.NewNop().Sugar())
+	var cancelled bool
+	handler := store.Handle(func(w http.ResponseWriter, r *http.Request) {
+		cancelled = r.Context().Err() != nil
+		countingHandler(&runs, released)(w, r)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/annotate", strings.NewReader(`{}`)).WithContext(ctx)
+	request.Header.Set(api.IdempotencyKeyHeader, "key")
+	handler(httptest.NewRecorder(), request)
+	assert.False(t, cancelled, "the first request completes after the client disconnects")
+
+	retry := send(handler, "key", `{}`)
+	assert.Equal(t, "true", retry.Header().Get(api.IdempotentReplayedHeader))
+	assert.Equal(t, int32(1), runs)
+}
+
+func TestHandleExpiry(t *testing.T) {
+	var runs int32
+	released := make(chan struct{})
+	close(released)
+	store := NewStore(time.Hour, 1, zap.NewNop().Sugar())
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	handler := store.Handle(countingHandler(&runs, released))
+
+	send(handler, "key-1", `{}`)
+	now = now.Add(2 * time.Hour)
+	send(handler, "key-1", `{}`)
+	assert.Equal(t, int32(2), runs, "expired outcomes aren't replayed")
+
+	send(handler, "key-2", `{}`)
+	send(handler, "key-1", `{}`)
+	assert.Equal(t, int32(4), runs, "the oldest outcome is dropped once the limit is reached")
+}
+
+func TestHandleNoResponse(t *testing.T) {
+	var runs int32
+	handler := NewStore(DefaultTTL, DefaultLimit, zap.NewNop().Sugar()).Handle(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&runs, 1)
+	})
+	send(handler, "key", `{}`)
+	send(handler, "key", `{}`)
+	assert.Equal(t, int32(2), runs, "a request that wrote no response runs again")
+}
+
+func TestHandleRetryAfter(t *testing.T) {
+	var runs int32
+	handler := NewStore(DefaultTTL, DefaultLimit, zap.NewNop().Sugar()).Handle(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			w.Header().Set(api.RetryAfterHeader, "5")
+			api.WriteError(w, r, api.NewError(http.StatusConflict, api.CodeConflict, api.ErrorInProgress+"1"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	assert.Equal(t, http.StatusConflict, send(handler, "key", `{}`).Code)
+	retry := send(handler, "key", `{}`)
+	assert.Equal(t, http.StatusOK, retry.Code, "a response asking for a retry isn't replayed")
+	assert.Empty(t, retry.Header().Get(api.IdempotentReplayedHeader))
+	assert.Equal(t, "true", send(handler, "key", `{}`).Header().Get(api.IdempotentReplayedHeader))
+}
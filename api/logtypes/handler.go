@@ -0,0 +1,45 @@
+package logtypes
+
+import (
+	"encoding/json"
+	"github.com/logzio/easy-connect-server/api"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// CatalogResponse is the response of the log types endpoint
+// log_types: the log types annotate requests accept, sorted by name
+type CatalogResponse struct {
+	LogTypes []LogType `json:"log_types"`
+}
+
+// Handler serves the log types endpoint
+type Handler struct {
+	app     *api.App
+	catalog *Catalog
+}
+
+// NewHandler creates a log types Handler that uses the app's clients
+func NewHandler(app *api.App) *Handler {
+	return &Handler{app: app, catalog: FromApp(app)}
+}
+
+// FromApp creates the Catalog of the app's configuration
+func FromApp(app *api.App) *Catalog {
+	return NewCatalog(app.Clientset, app.Config.LogTypesConfigMap, app.Logger)
+}
+
+// GetLogTypes returns the log types of the catalog, the built-in log types if the ConfigMap can't be read
+func (h *Handler) GetLogTypes(w http.ResponseWriter, r *http.Request) {
+	logger := h.app.Logger
+	logTypes, err := h.catalog.List(r.Context())
+	if err != nil {
+		if api.RequestCancelled(r, logger, "get log types configmap") {
+			return
+		}
+		logger.Warnw("Error reading the log types ConfigMap, returning the built-in log types", "configmap", h.app.Config.LogTypesConfigMap, zap.Error(err))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(CatalogResponse{LogTypes: logTypes})
+}
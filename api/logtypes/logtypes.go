@@ -0,0 +1,204 @@
+package logtypes
+
+import (
+	"context"
+	"go.uber.org/zap"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SourceBuiltIn is the source of the log types the server knows
+	SourceBuiltIn = "builtin"
+	// SourceConfigMap is the source of the log types of the catalog ConfigMap
+	SourceConfigMap = "configmap"
+	// MaxNameLength is the longest log type accepted
+	MaxNameLength = 63
+	// cacheTTL is how long the data of the ConfigMap is reused before it is read again
+	cacheTTL = 5 * time.Second
+)
+
+// NamePattern allows lowercase letters, digits, '_' and '-', starting with a letter or a digit
+var NamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// LogType is a log type of the catalog
+// name: the log type, as set in the logz.io/application_type annotation
+// description: what the log type parses
+// source: builtin or configmap
+type LogType struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Source      string `json:"source"`
+}
+
+// builtIn are the log types of the catalog without a ConfigMap
+var builtIn = map[string]string{
+	"apache":        "Apache access and error logs",
+	"apache_access": "Apache access logs in the common or combined format",
+	"docker":        "Plain container output",
+	"dotnet":        ".NET application logs",
+	"elasticsearch": "Elasticsearch server logs",
+	"golang":        "Go application logs",
+	"haproxy":       "HAProxy logs",
+	"java":          "Java application logs, including multiline stack traces",
+	"json":          "JSON objects, one per line",
+	"kafka":         "Kafka broker logs",
+	"logfmt":        "key=value pairs, one event per line",
+	"mongodb":       "MongoDB server logs",
+	"mysql":         "MySQL server logs",
+	"nginx":         "Nginx access and error logs",
+	"nginx_access":  "Nginx access logs in the combined format",
+	"nodejs":        "Node.js application logs",
+	"postgresql":    "PostgreSQL server logs",
+	"python":        "Python application logs, including multiline tracebacks",
+	"rabbitmq":      "RabbitMQ server logs",
+	"redis":         "Redis server logs",
+	"syslog":        "Syslog messages",
+}
+
+// Catalog is the log types annotate requests accept: the built-in log types and the entries of an optional ConfigMap, whose
+// keys are log types and values their descriptions. The ConfigMap is read at most once per cacheTTL, so changes apply within
+// seconds. Keys that aren't valid log types are skipped.
+type Catalog struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+	logger    *zap.SugaredLogger
+	now       func() time.Time
+
+	mu       sync.Mutex
+	data     map[string]string
+	readTime time.Time
+}
+
+// NewCatalog creates a Catalog that reads the ConfigMap configMap, given as namespace/name, with clientset. Only the built-in
+// log types are used if configMap is empty.
+func NewCatalog(clientset kubernetes.Interface, configMap string, logger *zap.SugaredLogger) *Catalog {
+	catalog := &Catalog{clientset: clientset, logger: logger, now: time.Now}
+	if namespace, name, ok := strings.Cut(configMap, "/"); ok {
+		catalog.namespace, catalog.name = namespace, name
+	}
+	return catalog
+}
+
+// List returns the log types of the catalog sorted by name, the descriptions of the ConfigMap override the built-in ones. A
+// missing ConfigMap is the same as an empty one. If the ConfigMap can't be read, the built-in log types are returned with the error.
+func (c *Catalog) List(ctx context.Context) ([]LogType, error) {
+	entries := map[string]LogType{}
+	for name, description := range builtIn {
+		entries[name] = LogType{Name: name, Description: description, Source: SourceBuiltIn}
+	}
+	data, err := c.configMapData(ctx)
+	for name, description := range data {
+		entries[name] = LogType{Name: name, Description: description, Source: SourceConfigMap}
+	}
+	logTypes := make([]LogType, 0, len(entries))
+	for _, logType := range entries {
+		logTypes = append(logTypes, logType)
+	}
+	sort.Slice(logTypes, func(i, j int) bool { return logTypes[i].Name < logTypes[j].Name })
+	return logTypes, err
+}
+
+// Names returns the set of log types of the catalog. If the ConfigMap can't be read, the error is logged and the built-in
+// log types are returned, so annotate requests and the state don't depend on it.
+func (c *Catalog) Names(ctx context.Context) map[string]bool {
+	logTypes, err := c.List(ctx)
+	if err != nil {
+		c.logger.Warnw("Error reading the log types ConfigMap, using the built-in log types", "configmap", c.namespace+"/"+c.name, zap.Error(err))
+	}
+	names := make(map[string]bool, len(logTypes))
+	for _, logType := range logTypes {
+		names[logType.Name] = true
+	}
+	return names
+}
+
+// ValidName reports whether name can be used as a log type
+func ValidName(name string) bool {
+	return len(name) <= MaxNameLength && NamePattern.MatchString(name)
+}
+
+// configMapData returns the valid entries of the ConfigMap, nil if there is no ConfigMap. The entries read in the last
+// cacheTTL are reused, errors aren't cached.
+func (c *Catalog) configMapData(ctx context.Context) (map[string]string, error) {
+	if c.name == "" {
+		return nil, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.readTime.IsZero() && c.now().Sub(c.readTime) < cacheTTL {
+		return c.data, nil
+	}
+	configMap, err := c.clientset.CoreV1().ConfigMaps(c.namespace).Get(ctx, c.name, v1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, err
+	}
+	c.data, c.readTime = nil, c.now()
+	if err == nil {
+		c.data = c.validEntries(configMap.Data)
+	}
+	return c.data, nil
+}
+
+// validEntries returns the entries of data whose keys are valid log types, the others are logged and skipped
+func (c *Catalog) validEntries(data map[string]string) map[string]string {
+	entries := make(map[string]string, len(data))
+	for name, description := range data {
+		if !ValidName(name) {
+			c.logger.Warnw("Skipping an invalid log type of the log types ConfigMap", "configmap", c.namespace+"/"+c.name, "log_type", name)
+			continue
+		}
+		entries[name] = description
+	}
+	return entries
+}
+
+// Closest returns the log type of names closest to name, to suggest it for a typo. It returns an empty string if no log
+// type is within two edits of name.
+func Closest(name string, names map[string]bool) string {
+	closest, best := "", 3
+	for candidate := range names {
+		if distance := editDistance(name, candidate); distance < best || (distance == best && candidate < closest) {
+			closest, best = candidate, distance
+		}
+	}
+	return closest
+}
+
+// editDistance returns the Levenshtein distance of a and b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func min(values ...int) int {
+	result := values[0]
+	for _, value := range values[1:] {
+		if value < result {
+			result = value
+		}
+	}
+	return result
+}
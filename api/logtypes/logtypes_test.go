@@ -0,0 +1,137 @@
+package logtypes
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func find(logTypes []LogType, name string) (LogType, bool) {
+	for _, logType := range logTypes {
+		if logType.Name == name {
+			return logType, true
+		}
+	}
+	return LogType{}, false
+}
+
+func TestCatalogList(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Namespace: "monitoring", Name: "log-types"},
+		Data:       map[string]string{"locust": "Locust load generator logs", "java": "Our java services", "MyApp": "Invalid", "app.log": "Invalid"},
+	}
+	catalog := NewCatalog(fake.NewSimpleClientset(configMap), "monitoring/log-types", zap.NewNop().Sugar())
+	logTypes, err := catalog.List(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, len(builtIn)+1, len(logTypes), "the keys that aren't valid log types are skipped")
+	assert.IsIncreasing(t, names(logTypes))
+	locust, _ := find(logTypes, "locust")
+	assert.Equal(t, LogType{Name: "locust", Description: "Locust load generator logs", Source: SourceConfigMap}, locust)
+	java, _ := find(logTypes, "java")
+	assert.Equal(t, SourceConfigMap, java.Source, "the ConfigMap overrides the built-in description")
+
+	missing := NewCatalog(fake.NewSimpleClientset(), "monitoring/log-types", zap.NewNop().Sugar())
+	logTypes, err = missing.List(context.Background())
+	require.NoError(t, err, "a missing ConfigMap is empty")
+	assert.Len(t, logTypes, len(builtIn))
+
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, k8serrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "log-types", nil)
+	})
+	forbidden := NewCatalog(clientset, "monitoring/log-types", zap.NewNop().Sugar())
+	_, err = forbidden.List(context.Background())
+	assert.True(t, k8serrors.IsForbidden(err))
+	assert.True(t, forbidden.Names(context.Background())["nginx"], "the built-in log types are used if the ConfigMap can't be read")
+}
+
+func names(logTypes []LogType) []string {
+	result := make([]string, 0, len(logTypes))
+	for _, logType := range logTypes {
+		result = append(result, logType.Name)
+	}
+	return result
+}
+
+func TestCatalogCache(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Namespace: "monitoring", Name: "log-types"},
+		Data:       map[string]string{"locust": "Locust load generator logs"},
+	}
+	clientset := fake.NewSimpleClientset(configMap)
+	catalog := NewCatalog(clientset, "monitoring/log-types", zap.NewNop().Sugar())
+	now := time.Now()
+	catalog.now = func() time.Time { return now }
+	require.True(t, catalog.Names(context.Background())["locust"])
+
+	configMap.Data = map[string]string{"k6": "k6 load generator logs"}
+	_, err := clientset.CoreV1().ConfigMaps("monitoring").Update(context.Background(), configMap, v1.UpdateOptions{})
+	require.NoError(t, err)
+	assert.True(t, catalog.Names(context.Background())["locust"], "the ConfigMap is cached")
+
+	now = now.Add(cacheTTL)
+	names := catalog.Names(context.Background())
+	assert.True(t, names["k6"], "the ConfigMap is read again once the cache expired")
+	assert.False(t, names["locust"])
+}
+
+func TestClosest(t *testing.T) {
+	known := map[string]bool{"nginx": true, "nginx_access": true, "java": true}
+	assert.Equal(t, "nginx", Closest("ngnix", known))
+	assert.Equal(t, "java", Closest("jav", known))
+	assert.Equal(t, "", Closest("postgres", known))
+}
+
+func TestGetLogTypes(t *testing.T) {
+	cfg := config.Default()
+	cfg.LogTypesConfigMap = ""
+	app := api.NewAppWithClients(cfg, zap.NewNop().Sugar(), fake.NewSimpleClientset(), nil)
+	recorder := httptest.NewRecorder()
+	NewHandler(app).GetLogTypes(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/log-types", nil))
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var response CatalogResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	nginx, ok := find(response.LogTypes, "nginx")
+	assert.True(t, ok)
+	assert.Equal(t, SourceBuiltIn, nginx.Source)
+
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, k8serrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "log-types", nil)
+	})
+	app = api.NewAppWithClients(config.Default(), zap.NewNop().Sugar(), clientset, nil)
+	recorder = httptest.NewRecorder()
+	NewHandler(app).GetLogTypes(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/log-types", nil))
+	require.Equal(t, http.StatusOK, recorder.Code, "the built-in log types are returned if the ConfigMap can't be read")
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Len(t, response.LogTypes, len(builtIn))
+}
+
+func TestSuggest(t *testing.T) {
+	assert.Equal(t, "nginx", Suggest("nginx", ""))
+	assert.Equal(t, "postgresql", Suggest("Postgres", ""))
+	assert.Equal(t, "nodejs", Suggest("", "javascript"))
+	assert.Equal(t, "redis", Suggest("redis", "go"), "the application is more specific than the language")
+	assert.Equal(t, "", Suggest("my-app", "cobol"))
+	for _, logType := range applicationLogTypes {
+		assert.Contains(t, builtIn, logType, "suggested log types are in the catalog")
+	}
+	for _, logType := range languageLogTypes {
+		assert.Contains(t, builtIn, logType, "suggested log types are in the catalog")
+	}
+}
@@ -0,0 +1,40 @@
+package logtypes
+
+import "strings"
+
+// applicationLogTypes are the recommended log types of the applications the instrumentor detects
+var applicationLogTypes = map[string]string{
+	"apache":        "apache",
+	"elasticsearch": "elasticsearch",
+	"haproxy":       "haproxy",
+	"httpd":         "apache",
+	"kafka":         "kafka",
+	"mongo":         "mongodb",
+	"mongodb":       "mongodb",
+	"mysql":         "mysql",
+	"mariadb":       "mysql",
+	"nginx":         "nginx",
+	"postgres":      "postgresql",
+	"postgresql":    "postgresql",
+	"rabbitmq":      "rabbitmq",
+	"redis":         "redis",
+}
+
+// languageLogTypes are the recommended log types of the languages the instrumentor detects
+var languageLogTypes = map[string]string{
+	"dotnet":     "dotnet",
+	"go":         "golang",
+	"java":       "java",
+	"javascript": "nodejs",
+	"nodejs":     "nodejs",
+	"python":     "python",
+}
+
+// Suggest returns the recommended log type of a container from its detected application, or from its detected language if
+// the application has no recommended log type. It returns an empty string if neither has one.
+func Suggest(application, language string) string {
+	if logType, ok := applicationLogTypes[strings.ToLower(application)]; ok {
+		return logType
+	}
+	return languageLogTypes[strings.ToLower(language)]
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// Names of the counters published at /debug/vars under easy_connect_server
+const (
+	MetricCancelledRequests = "cancelled_requests"
+)
+
+var metrics = expvar.NewMap("easy_connect_server")
+
+// IncrementMetric adds one to a counter
+func IncrementMetric(name string) {
+	metrics.Add(name, 1)
+}
+
+// MetricValue returns the current value of a counter
+func MetricValue(name string) int64 {
+	if counter, ok := metrics.Get(name).(*expvar.Int); ok {
+		return counter.Value()
+	}
+	return 0
+}
+
+// RequestCancelled reports whether the client of the request disconnected, in which case the cancellation is logged and counted.
+// stage describes what the handler was doing when the request was cancelled. A deadline of the request's context isn't a
+// cancellation, the handler reports it as a timeout.
+func RequestCancelled(r *http.Request, logger *zap.SugaredLogger, stage string) bool {
+	if !errors.Is(r.Context().Err(), context.Canceled) {
+		return false
+	}
+	logger.Infow("Request cancelled by the client", "stage", stage, "path", r.URL.Path, "request_id", RequestIDFrom(r.Context()))
+	IncrementMetric(MetricCancelledRequests)
+	return true
+}
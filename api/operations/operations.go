@@ -0,0 +1,237 @@
+package operations
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// DefaultLimit is the number of operations a Store keeps by default, older operations are dropped first
+const DefaultLimit = 1000
+
+// Types of operations
+const (
+	TypeAnnotate = "annotate"
+	TypeRevert   = "revert"
+)
+
+// Statuses of an operation
+const (
+	StatusRunning    = "running"
+	StatusSucceeded  = "succeeded"
+	StatusFailed     = "failed"
+	StatusRolledBack = "rolled_back"
+)
+
+// Workload identifies the workload an operation changed
+// namespace: the namespace of the workload
+// kind: the kind of the workload (deployment or statefulset)
+// name: the name of the workload
+type Workload struct {
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+}
+
+// Operation is the audit record of a change of the logz.io annotations of a workload's pod template
+// id: the id of the operation
+// type: what started the operation, annotate or revert
+// revert_of: the id of the operation a revert operation reverted
+// workload: the changed workload
+// container_name: the container the change was requested for
+// actor: who requested the change, if the client identified the user
+// request_id: the id of the request that started the operation
+// status: running, succeeded, failed or rolled_back
+// started_at, finished_at: when the operation started and finished
+// previous_annotations: the logz.io annotations of the pod template before the change
+// annotations: the logz.io annotations of the pod template after the change
+// generation: the generation of the workload after the change
+// error: why the operation failed
+// rollback_reason: why the change was rolled back
+type Operation struct {
+	ID                  string            `json:"id"`
+	Type                string            `json:"type"`
+	RevertOf            string            `json:"revert_of,omitempty"`
+	Workload            Workload          `json:"workload"`
+	ContainerName       string            `json:"container_name"`
+	Actor               string            `json:"actor,omitempty"`
+	RequestID           string            `json:"request_id,omitempty"`
+	Status              string            `json:"status"`
+	StartedAt           time.Time         `json:"started_at"`
+	FinishedAt          *time.Time        `json:"finished_at,omitempty"`
+	PreviousAnnotations map[string]string `json:"previous_annotations"`
+	Annotations         map[string]string `json:"annotations"`
+	Generation          int64             `json:"generation,omitempty"`
+	Error               string            `json:"error,omitempty"`
+	RollbackReason      string            `json:"rollback_reason,omitempty"`
+}
+
+// InFlightError is returned by StartExclusive when another operation runs on the workload
+type InFlightError struct {
+	Operation Operation
+}
+
+func (e *InFlightError) Error() string {
+	return "operation " + e.Operation.ID + " is in progress"
+}
+
+// flight is the operation that runs on a workload, done is closed once it finishes
+type flight struct {
+	id   string
+	done chan struct{}
+}
+
+// Store keeps the most recent operations in memory and writes every change of an operation to the audit log
+type Store struct {
+	logger *zap.SugaredLogger
+	limit  int
+	now    func() time.Time
+
+	mu         sync.Mutex
+	operations []*Operation
+	byID       map[string]*Operation
+	inFlight   map[Workload]*flight
+}
+
+// NewStore creates a Store that keeps the last limit operations
+func NewStore(limit int, logger *zap.SugaredLogger) *Store {
+	return &Store{
+		logger:   logger,
+		limit:    limit,
+		now:      time.Now,
+		byID:     map[string]*Operation{},
+		inFlight: map[Workload]*flight{},
+	}
+}
+
+// StartExclusive records a running operation once no other operation runs on its workload, so the operations of a workload
+// run one at a time. It returns the operation with its id and start time set. If wait is false, an *InFlightError with the running operation is returned
+// instead of waiting. The wait ends with the error of ctx if ctx is done first.
+func (s *Store) StartExclusive(ctx context.Context, operation Operation, wait bool) (Operation, error) {
+	for {
+		s.mu.Lock()
+		running, ok := s.inFlight[operation.Workload]
+		if !ok {
+			started := s.start(operation)
+			s.inFlight[operation.Workload] = &flight{id: started.ID, done: make(chan struct{})}
+			s.mu.Unlock()
+			return started, nil
+		}
+		if !wait {
+			inFlight := Operation{ID: running.id, Workload: operation.Workload, Status: StatusRunning}
+			if stored, ok := s.byID[running.id]; ok {
+				inFlight = *stored
+			}
+			s.mu.Unlock()
+			return Operation{}, &InFlightError{Operation: inFlight}
+		}
+		s.mu.Unlock()
+		select {
+		case <-running.done:
+		case <-ctx.Done():
+			return Operation{}, ctx.Err()
+		}
+	}
+}
+
+// start records a running operation, s.mu must be held
+func (s *Store) start(operation Operation) Operation {
+	operation.ID = newID()
+	operation.Status = StatusRunning
+	operation.StartedAt = s.now()
+	stored := operation
+	s.operations = append(s.operations, &stored)
+	s.byID[stored.ID] = &stored
+	if len(s.operations) > s.limit {
+		delete(s.byID, s.operations[0].ID)
+		s.operations = s.operations[1:]
+	}
+	s.audit("Operation started", stored)
+	return stored
+}
+
+// Update applies mutate to a stored operation, it is a no-op if the operation was dropped
+func (s *Store) Update(id string, mutate func(*Operation)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if operation, ok := s.byID[id]; ok {
+		mutate(operation)
+	}
+}
+
+// Finish records the final status of an operation, err is the error that failed it if any
+func (s *Store) Finish(id, status string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// release the workload even if the operation was dropped
+	for workload, running := range s.inFlight {
+		if running.id == id {
+			close(running.done)
+			delete(s.inFlight, workload)
+		}
+	}
+	operation, ok := s.byID[id]
+	if !ok {
+		return
+	}
+	finishedAt := s.now()
+	operation.Status = status
+	operation.FinishedAt = &finishedAt
+	if err != nil {
+		operation.Error = err.Error()
+	}
+	s.audit("Operation finished", *operation)
+}
+
+// Get returns a copy of an operation
+func (s *Store) Get(id string) (Operation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	operation, ok := s.byID[id]
+	if !ok {
+		return Operation{}, false
+	}
+	return *operation, true
+}
+
+// List returns copies of the operations of a workload, oldest first
+func (s *Store) List(workload Workload) []Operation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var operations []Operation
+	for _, operation := range s.operations {
+		if operation.Workload == workload {
+			operations = append(operations, *operation)
+		}
+	}
+	return operations
+}
+
+func (s *Store) audit(message string, operation Operation) {
+	s.logger.Infow(message,
+		"audit", true,
+		"operation_id", operation.ID,
+		"type", operation.Type,
+		"revert_of", operation.RevertOf,
+		"namespace", operation.Workload.Namespace,
+		"kind", operation.Workload.Kind,
+		"name", operation.Workload.Name,
+		"container_name", operation.ContainerName,
+		"actor", operation.Actor,
+		"request_id", operation.RequestID,
+		"status", operation.Status,
+		"previous_annotations", operation.PreviousAnnotations,
+		"annotations", operation.Annotations,
+		"error", operation.Error,
+		"rollback_reason", operation.RollbackReason,
+	)
+}
+
+func newID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,89 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+// start starts an operation on a workload without a running operation
+func start(t *testing.T, store *Store, operation Operation) Operation {
+	started, err := store.StartExclusive(context.Background(), operation, false)
+	require.NoError(t, err)
+	return started
+}
+
+func TestStore(t *testing.T) {
+	store := NewStore(2, zap.NewNop().Sugar())
+	adservice := Workload{Namespace: "default", Kind: "deployment", Name: "adservice"}
+	first := start(t, store, Operation{Type: TypeAnnotate, Workload: adservice, Actor: "jane"})
+	assert.NotEmpty(t, first.ID)
+	assert.Equal(t, StatusRunning, first.Status)
+	assert.False(t, first.StartedAt.IsZero())
+
+	store.Update(first.ID, func(operation *Operation) {
+		operation.PreviousAnnotations = map[string]string{"logz.io/application_type": "java"}
+	})
+	store.Finish(first.ID, StatusFailed, errors.New("timeout"))
+	stored, ok := store.Get(first.ID)
+	require.True(t, ok)
+	assert.Equal(t, StatusFailed, stored.Status)
+	assert.Equal(t, "timeout", stored.Error)
+	assert.NotNil(t, stored.FinishedAt)
+	assert.Equal(t, "java", stored.PreviousAnnotations["logz.io/application_type"])
+
+	second := start(t, store, Operation{Type: TypeAnnotate, Workload: Workload{Namespace: "default", Kind: "statefulset", Name: "redis-cart"}})
+	third := start(t, store, Operation{Type: TypeAnnotate, Workload: adservice})
+	_, ok = store.Get(first.ID)
+	assert.False(t, ok, "the oldest operation is dropped once the limit is reached")
+	_, ok = store.Get(second.ID)
+	assert.True(t, ok)
+
+	operations := store.List(adservice)
+	require.Len(t, operations, 1)
+	assert.Equal(t, third.ID, operations[0].ID)
+}
+
+func TestStartExclusive(t *testing.T) {
+	store := NewStore(DefaultLimit, zap.NewNop().Sugar())
+	adservice := Workload{Namespace: "default", Kind: "deployment", Name: "adservice"}
+	first, err := store.StartExclusive(context.Background(), Operation{Type: TypeAnnotate, Workload: adservice, Actor: "jane"}, false)
+	require.NoError(t, err)
+
+	_, err = store.StartExclusive(context.Background(), Operation{Type: TypeAnnotate, Workload: adservice}, false)
+	var inFlight *InFlightError
+	require.ErrorAs(t, err, &inFlight)
+	assert.Equal(t, first.ID, inFlight.Operation.ID)
+	assert.Equal(t, "jane", inFlight.Operation.Actor)
+
+	other, err := store.StartExclusive(context.Background(), Operation{Type: TypeAnnotate, Workload: Workload{Namespace: "default", Kind: "statefulset", Name: "redis-cart"}}, false)
+	require.NoError(t, err, "operations of other workloads run concurrently")
+	store.Finish(other.ID, StatusSucceeded, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = store.StartExclusive(ctx, Operation{Type: TypeAnnotate, Workload: adservice}, true)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	started := make(chan Operation)
+	go func() {
+		second, err := store.StartExclusive(context.Background(), Operation{Type: TypeAnnotate, Workload: adservice}, true)
+		assert.NoError(t, err)
+		started <- second
+	}()
+	select {
+	case <-started:
+		t.Fatal("the second operation started while the first one is running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	store.Finish(first.ID, StatusSucceeded, nil)
+	second := <-started
+	assert.NotEqual(t, first.ID, second.ID)
+	stored, ok := store.Get(second.ID)
+	require.True(t, ok)
+	assert.Equal(t, StatusRunning, stored.Status)
+}
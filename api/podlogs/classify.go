@@ -0,0 +1,100 @@
+package podlogs
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxSamples is how many matching lines are returned with a suggestion
+const maxSamples = 3
+
+// classifier recognizes the lines of a log format
+// format: the name of the format
+// logType: the log type that parses the format
+// matches: whether a line has the format
+type classifier struct {
+	format  string
+	logType string
+	matches func(line string) bool
+}
+
+var (
+	// combinedAccessPattern matches the combined log format of nginx and apache: the common log format with the referer and the user agent
+	combinedAccessPattern = regexp.MustCompile(`^\S+ \S+ \S+ \[[^\]]+\] "[^"]*" \d{3} (\d+|-) "[^"]*" "[^"]*"`)
+	// commonAccessPattern matches the common log format of apache
+	commonAccessPattern = regexp.MustCompile(`^\S+ \S+ \S+ \[[^\]]+\] "[^"]*" \d{3} (\d+|-)\s*$`)
+	// syslogPattern matches RFC 3164 and RFC 5424 syslog messages
+	syslogPattern = regexp.MustCompile(`^(<\d{1,3}>)?([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2} \S+ \S+?(\[\d+\])?: |1 \d{4}-\d{2}-\d{2}T\S+ \S+ \S+ \S+ \S+ )`)
+	// javaStackTracePattern matches the lines of a java stack trace and the exception that starts it
+	javaStackTracePattern = regexp.MustCompile(`^(\s+at [\w$.<>]+\(.*\)|\s*\.\.\. \d+ (more|common frames omitted)|(Caused by: |Exception in thread "[^"]*" )?([a-z_$][\w$]*\.)+[\w$]*(Exception|Error|Throwable)(: .*)?)$`)
+	// logfmtPairPattern matches a key=value pair of logfmt
+	logfmtPairPattern = regexp.MustCompile(`(?:^|\s)[\w.-]+=(?:"(?:[^"\\]|\\.)*"|[^\s"]*)`)
+)
+
+// classifiers are the log formats samples are checked for
+var classifiers = []classifier{
+	{format: "json", logType: "json", matches: func(line string) bool {
+		line = strings.TrimSpace(line)
+		return strings.HasPrefix(line, "{") && json.Valid([]byte(line))
+	}},
+	{format: "nginx_access", logType: "nginx_access", matches: combinedAccessPattern.MatchString},
+	{format: "apache_access", logType: "apache_access", matches: func(line string) bool {
+		return combinedAccessPattern.MatchString(line) || commonAccessPattern.MatchString(line)
+	}},
+	{format: "syslog", logType: "syslog", matches: syslogPattern.MatchString},
+	{format: "java_stacktrace", logType: "java", matches: javaStackTracePattern.MatchString},
+	{format: "logfmt", logType: "logfmt", matches: func(line string) bool {
+		pairs := logfmtPairPattern.FindAllString(line, -1)
+		return len(pairs) >= 2 && len(strings.TrimSpace(logfmtPairPattern.ReplaceAllString(line, ""))) == 0
+	}},
+}
+
+// Suggestion is a log type suggested for the format of sampled log lines
+// log_type: the suggested log type
+// format: the format the lines have
+// matches: how many of the sampled lines have the format
+// ratio: the share of the non-empty sampled lines that have the format
+// samples: the first lines that have the format
+type Suggestion struct {
+	LogType string   `json:"log_type"`
+	Format  string   `json:"format"`
+	Matches int      `json:"matches"`
+	Ratio   float64  `json:"ratio"`
+	Samples []string `json:"samples"`
+}
+
+// Classify checks the lines for every known log format and returns a suggestion for each format some lines have, the formats
+// most lines have first
+func Classify(lines []string) []Suggestion {
+	suggestions := []Suggestion{}
+	total := 0
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			total++
+		}
+	}
+	if total == 0 {
+		return suggestions
+	}
+	for _, c := range classifiers {
+		suggestion := Suggestion{LogType: c.logType, Format: c.format, Samples: []string{}}
+		for _, line := range lines {
+			if strings.TrimSpace(line) == "" || !c.matches(line) {
+				continue
+			}
+			suggestion.Matches++
+			if len(suggestion.Samples) < maxSamples {
+				suggestion.Samples = append(suggestion.Samples, line)
+			}
+		}
+		if suggestion.Matches > 0 {
+			suggestion.Ratio = float64(suggestion.Matches) / float64(total)
+			suggestions = append(suggestions, suggestion)
+		}
+	}
+	// the order of the classifiers breaks ties, e.g. nginx before apache for the combined log format
+	sort.SliceStable(suggestions, func(i, j int) bool { return suggestions[i].Matches > suggestions[j].Matches })
+	return suggestions
+}
@@ -0,0 +1,64 @@
+package podlogs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	testCases := []struct {
+		description string
+		lines       []string
+		formats     []string
+	}{
+		{"json", []string{`{"level":"info","msg":"started"}`, `{"level":"error","msg":"failed"}`}, []string{"json"}},
+		{"combined access log", []string{
+			`10.0.0.1 - - [01/May/2024:14:03:10 +0000] "GET /cart HTTP/1.1" 200 512 "-" "Mozilla/5.0"`,
+		}, []string{"nginx_access", "apache_access"}},
+		{"common access log", []string{`10.0.0.1 - frank [01/May/2024:14:03:10 +0000] "GET /index.html HTTP/1.0" 200 2326`}, []string{"apache_access"}},
+		{"syslog", []string{
+			`May  1 14:03:10 web-1 sshd[4123]: Accepted publickey for root`,
+			`<34>1 2024-05-01T14:03:10.003Z web-1 su - ID47 - 'su root' failed`,
+		}, []string{"syslog"}},
+		{"java stack trace", []string{
+			`java.lang.IllegalStateException: cart is empty`,
+			`	at com.shop.Cart.checkout(Cart.java:42)`,
+			`	at com.shop.Api.handle(Api.java:7)`,
+			`Caused by: java.io.IOException: broken pipe`,
+			`	... 12 more`,
+		}, []string{"java_stacktrace"}},
+		{"logfmt", []string{`level=info msg="request done" duration=12ms`, `ts=2024-05-01T14:03:10Z level=warn`}, []string{"logfmt"}},
+		{"plain text", []string{"starting server", "listening on :8080"}, []string{}},
+		{"empty lines", []string{"", "  "}, []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			formats := []string{}
+			for _, suggestion := range Classify(tc.lines) {
+				formats = append(formats, suggestion.Format)
+				assert.Equal(t, len(tc.lines), suggestion.Matches, suggestion.Format)
+				assert.Equal(t, 1.0, suggestion.Ratio)
+			}
+			assert.Equal(t, tc.formats, formats)
+		})
+	}
+}
+
+func TestClassifyRanking(t *testing.T) {
+	lines := []string{
+		`{"msg":"one"}`,
+		`level=info msg=two`,
+		`{"msg":"three"}`,
+		`{"msg":"four"}`,
+		`{"msg":"five"}`,
+		"",
+	}
+	suggestions := Classify(lines)
+	require.Len(t, suggestions, 2)
+	assert.Equal(t, "json", suggestions[0].LogType)
+	assert.Equal(t, 4, suggestions[0].Matches)
+	assert.Equal(t, 0.8, suggestions[0].Ratio, "empty lines aren't counted")
+	assert.Equal(t, []string{`{"msg":"one"}`, `{"msg":"three"}`, `{"msg":"four"}`}, suggestions[0].Samples)
+	assert.Equal(t, "logfmt", suggestions[1].LogType)
+}
@@ -0,0 +1,133 @@
+package podlogs
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/logzio/easy-connect-server/api"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// sampleLimitBytes is the most log bytes read to suggest log types
+	sampleLimitBytes = 1 << 20
+	// previewLimitBytes is the most log bytes returned by the logs endpoint
+	previewLimitBytes = 256 << 10
+)
+
+// ContainerLogs is the response of the logs endpoint
+// pod, container: where the lines were read from
+// lines: the last log lines of the container, oldest first, with their secrets redacted
+// truncated: whether the oldest lines were dropped to fit the size limit
+// redactions: how many secrets were redacted
+type ContainerLogs struct {
+	Pod        string   `json:"pod"`
+	Container  string   `json:"container"`
+	Lines      []string `json:"lines"`
+	Truncated  bool     `json:"truncated"`
+	Redactions int      `json:"redactions"`
+}
+
+// LogTypeSuggestions is the response of the log type detection endpoint
+// pod, container: where the lines were read from
+// lines_read: how many log lines were classified
+// truncated: whether the oldest lines were dropped to fit the byte limit of the read
+// suggestions: a log type for every format some lines have, the formats most lines have first
+type LogTypeSuggestions struct {
+	Pod         string       `json:"pod"`
+	Container   string       `json:"container"`
+	LinesRead   int          `json:"lines_read"`
+	Truncated   bool         `json:"truncated"`
+	Suggestions []Suggestion `json:"suggestions"`
+}
+
+// Handler serves the endpoints that read the logs of a container
+type Handler struct {
+	app *api.App
+}
+
+// NewHandler creates a pod logs Handler that uses the app's clients
+func NewHandler(app *api.App) *Handler {
+	return &Handler{app: app}
+}
+
+// SuggestLogTypes reads the last lines a container of a workload logged and suggests log types for their formats
+func (h *Handler) SuggestLogTypes(w http.ResponseWriter, r *http.Request) {
+	sample, ok := h.read(w, r, sampleLimitBytes)
+	if !ok {
+		return
+	}
+	response := LogTypeSuggestions{
+		Pod:         sample.Pod,
+		Container:   sample.Container,
+		LinesRead:   len(sample.Lines),
+		Truncated:   sample.Truncated,
+		Suggestions: Classify(sample.Lines),
+	}
+	// the lines are classified as logged, the samples returned are redacted like the lines of the logs endpoint
+	redactedLines := append([]string(nil), sample.Lines...)
+	RedactLines(redactedLines)
+	redactedSamples := make(map[string]string, len(sample.Lines))
+	for i, line := range sample.Lines {
+		redactedSamples[line] = redactedLines[i]
+	}
+	for _, suggestion := range response.Suggestions {
+		for i, line := range suggestion.Samples {
+			suggestion.Samples[i] = redactedSamples[line]
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetLogs returns the last lines a container of a workload logged in a ready pod, with their secrets redacted
+func (h *Handler) GetLogs(w http.ResponseWriter, r *http.Request) {
+	sample, ok := h.read(w, r, previewLimitBytes)
+	if !ok {
+		return
+	}
+	response := ContainerLogs{Pod: sample.Pod, Container: sample.Container, Lines: sample.Lines, Truncated: sample.Truncated}
+	response.Redactions = RedactLines(response.Lines)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// read reads the lines of the container of the request path, at most the lines query parameter and limitBytes. If the
+// request is invalid or the lines can't be read, the error is written to w and ok is false.
+func (h *Handler) read(w http.ResponseWriter, r *http.Request, limitBytes int64) (*Sample, bool) {
+	logger := h.app.Logger
+	vars := mux.Vars(r)
+	namespace, kind, name, container := vars["namespace"], strings.ToLower(vars["kind"]), vars["name"], vars["container"]
+	if kind != api.KindDeployment && kind != api.KindStatefulSet {
+		api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+"kind must be one of "+strings.Join(api.ValidKinds, ", ")))
+		return nil, false
+	}
+	lines := DefaultLines
+	if value := r.URL.Query().Get("lines"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > MaxLines {
+			api.WriteError(w, r, api.NewError(http.StatusBadRequest, api.CodeInvalidInput, api.ErrorInvalidInput+"lines must be a number from 1 to "+strconv.Itoa(MaxLines)))
+			return nil, false
+		}
+		lines = parsed
+	}
+	sample, err := Read(r.Context(), h.app.Clientset, namespace, kind, name, container, lines, limitBytes)
+	switch {
+	case errors.Is(err, ErrNoReadyPod):
+		api.WriteError(w, r, api.NewError(http.StatusNotFound, api.CodeNotFound, api.ErrorNoReadyPod+name+"/"+container))
+		return nil, false
+	case err != nil:
+		if api.RequestCancelled(r, logger, "read container logs") {
+			return nil, false
+		}
+		logger.Error(api.ErrorGet, zap.Error(err))
+		api.WriteError(w, r, api.FromKubernetesError(api.ErrorGet, err))
+		return nil, false
+	}
+	return sample, true
+}
@@ -0,0 +1,155 @@
+package podlogs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/logzio/easy-connect-server/api"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+)
+
+const (
+	// DefaultLines is how many log lines are read if the request doesn't set it
+	DefaultLines = 100
+	// MaxLines is the most log lines a request can read
+	MaxLines = 1000
+)
+
+// ErrNoReadyPod is returned if no ready pod of the workload runs the container
+var ErrNoReadyPod = errors.New("no ready pod of the workload runs the container")
+
+// Sample is the last lines a container of a workload logged
+// pod: the pod the lines were read from
+// container: the container of the pod
+// lines: the log lines, oldest first
+// truncated: whether the oldest lines were dropped to fit the byte limit of the read
+type Sample struct {
+	Pod       string   `json:"pod"`
+	Container string   `json:"container"`
+	Lines     []string `json:"lines"`
+	Truncated bool     `json:"truncated"`
+}
+
+// Read picks a ready pod of a workload that runs the container and reads its last lines with the pods/log subresource.
+// The lines are streamed and the oldest ones are dropped until the rest fit in limitBytes, so the sample always has the
+// most recent lines. The workload must be a deployment or a statefulset.
+func Read(ctx context.Context, clientset kubernetes.Interface, namespace, kind, name, container string, lines int, limitBytes int64) (*Sample, error) {
+	pod, err := readyPod(ctx, clientset, namespace, kind, name, container)
+	if err != nil {
+		return nil, err
+	}
+	tailLines := int64(lines)
+	// LimitBytes would keep the first bytes of the tail and drop the most recent lines, the tail is bounded by TailLines instead
+	stream, err := clientset.CoreV1().Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: container,
+		TailLines: &tailLines,
+	}).Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	sample := &Sample{Pod: pod.Name, Container: container}
+	sample.Lines, sample.Truncated, err = tail(stream, limitBytes)
+	if err != nil {
+		return nil, err
+	}
+	return sample, nil
+}
+
+// tail returns the most recent lines of reader that fit in limitBytes, counting their newlines, and whether older lines
+// were dropped. Only limitBytes and the line being read are held in memory.
+func tail(reader io.Reader, limitBytes int64) ([]string, bool, error) {
+	lines, truncated := []string{}, false
+	var size int64
+	buffered := bufio.NewReader(reader)
+	for {
+		line, tooLong, err := readLine(buffered, limitBytes)
+		if err == io.EOF {
+			return lines, truncated, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if tooLong {
+			// the older lines can't be reported without this one
+			lines, size, truncated = []string{}, 0, true
+			continue
+		}
+		lines, size = append(lines, line), size+int64(len(line))+1
+		for size > limitBytes {
+			lines, size, truncated = lines[1:], size-int64(len(lines[0]))-1, true
+		}
+	}
+}
+
+// readLine returns the next line of reader without its line ending. If the line doesn't fit in limitBytes with its newline,
+// the rest of it is skipped and tooLong is true. io.EOF is returned once every line was read.
+func readLine(reader *bufio.Reader, limitBytes int64) (line string, tooLong bool, err error) {
+	var data []byte
+	for {
+		fragment, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return "", false, err
+		}
+		if !tooLong {
+			data = append(data, fragment...)
+			if tooLong = int64(len(data))+1 > limitBytes; tooLong {
+				data = nil
+			}
+		}
+		if !isPrefix {
+			return string(data), tooLong, nil
+		}
+	}
+}
+
+// readyPod returns a ready pod selected by the workload that runs the container, the oldest one so the sample isn't taken
+// from a pod that just started
+func readyPod(ctx context.Context, clientset kubernetes.Interface, namespace, kind, name, container string) (*corev1.Pod, error) {
+	var selector *v1.LabelSelector
+	switch kind {
+	case api.KindDeployment:
+		deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = deployment.Spec.Selector
+	case api.KindStatefulSet:
+		statefulSet, err := clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = statefulSet.Spec.Selector
+	default:
+		return nil, fmt.Errorf("unsupported kind %q", kind)
+	}
+	labelSelector, err := v1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, v1.ListOptions{LabelSelector: labelSelector.String()})
+	if err != nil {
+		return nil, err
+	}
+	var candidates []corev1.Pod
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp == nil && api.PodReady(&pod) && api.HasContainer(&pod.Spec, container) {
+			candidates = append(candidates, pod)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoReadyPod
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if !candidates[i].CreationTimestamp.Equal(&candidates[j].CreationTimestamp) {
+			return candidates[i].CreationTimestamp.Before(&candidates[j].CreationTimestamp)
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	return &candidates[0], nil
+}
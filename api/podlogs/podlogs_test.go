@@ -0,0 +1,127 @@
+package podlogs
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/config"
+	"github.com/logzio/easy-connect-server/api/simulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pod builds a pod of the adservice deployment created at the given time
+func pod(name string, ready bool, created time.Time, containerNames ...string) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: name, Labels: map[string]string{"app": "adservice"}, CreationTimestamp: v1.NewTime(created)},
+		Status:     corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}}},
+	}
+	for _, containerName := range containerNames {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: containerName})
+	}
+	return pod
+}
+
+func TestReadyPod(t *testing.T) {
+	now := time.Now()
+	clientset := simulator.NewClientset(
+		simulator.Deployment("default", "adservice", "server", "sidecar"),
+		pod("adservice-unready", false, now.Add(-time.Hour), "server"),
+		pod("adservice-old", true, now.Add(-time.Minute), "server"),
+		pod("adservice-new", true, now, "server", "sidecar"),
+	)
+	selected, err := readyPod(context.Background(), clientset, "default", api.KindDeployment, "adservice", "server")
+	require.NoError(t, err)
+	assert.Equal(t, "adservice-old", selected.Name, "the oldest ready pod is selected")
+
+	selected, err = readyPod(context.Background(), clientset, "default", api.KindDeployment, "adservice", "sidecar")
+	require.NoError(t, err)
+	assert.Equal(t, "adservice-new", selected.Name)
+
+	_, err = readyPod(context.Background(), clientset, "default", api.KindDeployment, "adservice", "worker")
+	assert.ErrorIs(t, err, ErrNoReadyPod)
+}
+
+func suggest(t *testing.T, objects []runtime.Object, kind, query string) *httptest.ResponseRecorder {
+	app := api.NewAppWithClients(config.Default(), zap.NewNop().Sugar(), simulator.NewClientset(objects...), simulator.NewDynamicClient())
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/workloads/default/"+kind+"/adservice/containers/server/log-type-suggestions"+query, nil)
+	NewHandler(app).SuggestLogTypes(recorder, mux.SetURLVars(request, map[string]string{"namespace": "default", "kind": kind, "name": "adservice", "container": "server"}))
+	return recorder
+}
+
+func TestSuggestLogTypes(t *testing.T) {
+	objects := []runtime.Object{simulator.Deployment("default", "adservice", "server"), pod("adservice-1", true, time.Now(), "server")}
+	recorder := suggest(t, objects, "Deployment", "?lines=50")
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var response LogTypeSuggestions
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "adservice-1", response.Pod)
+	assert.Equal(t, "server", response.Container)
+	// the fake clientset returns "fake logs" for every pod
+	assert.Equal(t, 1, response.LinesRead)
+	assert.Empty(t, response.Suggestions)
+
+	assert.Equal(t, http.StatusNotFound, suggest(t, objects[:1], "deployment", "").Code, "no ready pod")
+	assert.Equal(t, http.StatusNotFound, suggest(t, nil, "deployment", "").Code, "no workload")
+	assert.Equal(t, http.StatusBadRequest, suggest(t, objects, "cronjob", "").Code)
+	assert.Equal(t, http.StatusBadRequest, suggest(t, objects, "deployment", "?lines=0").Code)
+	assert.Equal(t, http.StatusBadRequest, suggest(t, objects, "deployment", "?lines=5000").Code)
+}
+
+func TestGetLogs(t *testing.T) {
+	objects := []runtime.Object{simulator.Deployment("default", "adservice", "server"), pod("adservice-1", true, time.Now(), "server")}
+	app := api.NewAppWithClients(config.Default(), zap.NewNop().Sugar(), simulator.NewClientset(objects...), simulator.NewDynamicClient())
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/workloads/default/deployment/adservice/containers/server/logs?lines=10", nil)
+	NewHandler(app).GetLogs(recorder, mux.SetURLVars(request, map[string]string{"namespace": "default", "kind": "deployment", "name": "adservice", "container": "server"}))
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	var response ContainerLogs
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "adservice-1", response.Pod)
+	// the fake clientset returns "fake logs" for every pod
+	assert.Equal(t, []string{"fake logs"}, response.Lines)
+	assert.False(t, response.Truncated)
+
+	// a line longer than the size limit is dropped
+	sample, err := Read(context.Background(), app.Clientset, "default", api.KindDeployment, "adservice", "server", 10, 4)
+	require.NoError(t, err)
+	assert.True(t, sample.Truncated)
+	assert.Empty(t, sample.Lines)
+}
+
+func TestTail(t *testing.T) {
+	lines, truncated, err := tail(strings.NewReader("first\nsecond\nthird\n"), 100)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first", "second", "third"}, lines)
+	assert.False(t, truncated)
+
+	lines, truncated, err = tail(strings.NewReader("first\nsecond\nthird"), 13)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"second", "third"}, lines, "the oldest lines are dropped to fit the limit")
+	assert.True(t, truncated)
+
+	lines, truncated, err = tail(strings.NewReader("first\n"+strings.Repeat("x", 20)+"\nthird\n"), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"third"}, lines, "a line longer than the limit drops the older lines")
+	assert.True(t, truncated)
+
+	lines, truncated, err = tail(strings.NewReader(""), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, lines)
+	assert.False(t, truncated)
+}
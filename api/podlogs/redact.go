@@ -0,0 +1,88 @@
+package podlogs
+
+import "regexp"
+
+// redacted replaces the secrets found in log lines
+const redacted = "[REDACTED]"
+
+// redaction replaces the secret part of the matches of pattern with replacement, which can refer to the groups of pattern
+type redaction struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// secretKeys are the keys whose values are secrets in key=value, key: value and "key": "value" pairs
+const secretKeys = `(?i)((?:password|passwd|pwd|secret|token|api[_-]?key|access[_-]?key|private[_-]?key|credentials?|auth)"?\s*[=:]\s*`
+
+var (
+	// privateKeyBegin and privateKeyEnd are the first and last lines of a PEM private key
+	privateKeyBegin = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)
+	privateKeyEnd   = regexp.MustCompile(`-----END [A-Z ]*PRIVATE KEY-----`)
+	// pemLine is a line of the base64 body of a PEM block, they have 64 characters but the last one
+	pemLine = regexp.MustCompile(`^\s*[A-Za-z0-9+/=]{16,}\s*$`)
+)
+
+// redactions are the secret patterns removed from the log lines the server returns
+var redactions = []redaction{
+	// private keys logged on one line
+	{regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----.*`), redacted},
+	// authorization headers
+	{regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]{8,}`), "${1} " + redacted},
+	// JSON web tokens
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`), redacted},
+	// AWS access key ids
+	{regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`), redacted},
+	// credentials in URLs
+	{regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`), "${1}" + redacted + "@"},
+	// quoted values of secret keys, up to the closing quote
+	{regexp.MustCompile(secretKeys + `")(?:[^"\\]|\\.)+"`), "${1}" + redacted + `"`},
+	{regexp.MustCompile(secretKeys + `')(?:[^'\\]|\\.)+'`), "${1}" + redacted + `'`},
+	// unquoted values of secret keys, up to the first space or separator
+	{regexp.MustCompile(secretKeys + `)([^\s"',;&]+)`), "${1}" + redacted},
+}
+
+// RedactLines redacts the secrets of consecutive log lines in place, like Redact, and the bodies of private keys logged over
+// several lines, from the BEGIN line to the END line. It returns how many secrets were replaced.
+func RedactLines(lines []string) int {
+	count := 0
+	inKey := false
+	for i, line := range lines {
+		switch {
+		case inKey:
+			inKey = !privateKeyEnd.MatchString(line)
+			lines[i] = redacted
+		case privateKeyBegin.MatchString(line):
+			inKey = !privateKeyEnd.MatchString(line)
+			lines[i] = redacted
+			count++
+		case privateKeyEnd.MatchString(line):
+			// the lines were read from the middle of a key, its body starts with the first line
+			for j := i - 1; j >= 0 && pemLine.MatchString(lines[j]); j-- {
+				lines[j] = redacted
+			}
+			lines[i] = redacted
+			count++
+		default:
+			var n int
+			lines[i], n = Redact(line)
+			count += n
+		}
+	}
+	return count
+}
+
+// Redact replaces the secrets of a log line, like passwords, tokens and keys, with [REDACTED]. It returns the line and how
+// many secrets were replaced.
+func Redact(line string) (string, int) {
+	count := 0
+	for _, r := range redactions {
+		line = r.pattern.ReplaceAllStringFunc(line, func(match string) string {
+			replaced := r.pattern.ReplaceAllString(match, r.replacement)
+			if replaced != match {
+				count++
+			}
+			return replaced
+		})
+	}
+	return line, count
+}
@@ -0,0 +1,27 @@
+package api
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PodReady reports whether the pod's Ready condition is true
+func PodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// HasContainer reports whether the pod spec has a container or an init container with the given name
+func HasContainer(spec *corev1.PodSpec, name string) bool {
+	for _, containers := range [][]corev1.Container{spec.Containers, spec.InitContainers} {
+		for _, container := range containers {
+			if container.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+func TestPodReady(t *testing.T) {
+	pod := &corev1.Pod{Status: corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}}}
+	assert.True(t, PodReady(pod))
+	pod.Status.Conditions[0].Status = corev1.ConditionFalse
+	assert.False(t, PodReady(pod))
+	assert.False(t, PodReady(&corev1.Pod{}), "a pod without a Ready condition isn't ready")
+}
+
+func TestHasContainer(t *testing.T) {
+	spec := &corev1.PodSpec{Containers: []corev1.Container{{Name: "server"}}, InitContainers: []corev1.Container{{Name: "migrate"}}}
+	assert.True(t, HasContainer(spec, "server"))
+	assert.True(t, HasContainer(spec, "migrate"))
+	assert.False(t, HasContainer(spec, "proxy"))
+}
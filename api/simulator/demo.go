@@ -0,0 +1,154 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/config"
+	"io"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	kindInstrumentedApplication = "InstrumentedApplication"
+	defaultNamespace            = "default"
+)
+
+// knownApplications maps container image names to the application the instrumentor detects for them
+var knownApplications = map[string]string{
+	"redis":         "redis",
+	"mongo":         "mongodb",
+	"mysql":         "mysql",
+	"postgres":      "postgresql",
+	"rabbitmq":      "rabbitmq",
+	"nginx":         "nginx",
+	"kafka":         "kafka",
+	"elasticsearch": "elasticsearch",
+	"memcached":     "memcached",
+}
+
+// NewDemoApp creates an App that serves the workloads and InstrumentedApplication resources of the configured fixture files
+// from memory, without a cluster. A simulated instrumentor updates the resources and a simulated controller rolls out pods
+// when workloads are annotated, until ctx is done.
+func NewDemoApp(ctx context.Context, cfg *config.Config) (*api.App, error) {
+	workloads, crds, err := LoadFixtures(cfg.DemoFixtures...)
+	if err != nil {
+		return nil, err
+	}
+	crds = append(crds, GenerateInstrumentedApplications(workloads, crds)...)
+	logger := api.InitLogger(cfg)
+	logger.Infof("Demo mode: serving %d workloads and %d instrumented applications from %s", len(workloads), len(crds), strings.Join(cfg.DemoFixtures, ", "))
+	app := api.NewAppWithClients(cfg, logger, NewClientset(workloads...), NewDynamicClient(crds...))
+	delay := time.Duration(cfg.DemoInstrumentorDelaySeconds) * time.Second
+	NewInstrumentor(app.Clientset, app.DynamicClient, logger, delay).Start(ctx)
+	NewRolloutController(app.Clientset, logger, delay).Start(ctx)
+	return app, nil
+}
+
+// LoadFixtures reads the deployments, statefulsets and InstrumentedApplication resources of multi document YAML files.
+// Other kinds are ignored, objects without a namespace are placed in the default namespace.
+func LoadFixtures(paths ...string) (workloads []runtime.Object, crds []runtime.Object, err error) {
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading demo fixtures: %w", err)
+		}
+		fileWorkloads, fileCrds, err := decodeFixtures(file)
+		file.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing demo fixtures %s: %w", path, err)
+		}
+		workloads = append(workloads, fileWorkloads...)
+		crds = append(crds, fileCrds...)
+	}
+	return workloads, crds, nil
+}
+
+func decodeFixtures(reader io.Reader) (workloads []runtime.Object, crds []runtime.Object, err error) {
+	decoder := yaml.NewYAMLOrJSONDecoder(reader, 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		if err = decoder.Decode(&obj.Object); err == io.EOF {
+			return workloads, crds, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+		if obj.GetNamespace() == "" {
+			obj.SetNamespace(defaultNamespace)
+		}
+		var typed runtime.Object
+		switch obj.GetKind() {
+		case kindInstrumentedApplication:
+			crds = append(crds, obj)
+			continue
+		case "Deployment":
+			typed = &appsv1.Deployment{}
+		case "StatefulSet":
+			typed = &appsv1.StatefulSet{}
+		default:
+			continue
+		}
+		if err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, typed); err != nil {
+			return nil, nil, fmt.Errorf("%s %s/%s: %w", obj.GetKind(), obj.GetNamespace(), obj.GetName(), err)
+		}
+		workloads = append(workloads, typed)
+	}
+}
+
+// GenerateInstrumentedApplications creates the InstrumentedApplication resources missing for workloads.
+// Containers running a known application image get an applications entry, languages are never guessed.
+func GenerateInstrumentedApplications(workloads []runtime.Object, crds []runtime.Object) []runtime.Object {
+	existing := map[string]bool{}
+	for _, crd := range crds {
+		obj := crd.(*unstructured.Unstructured)
+		existing[obj.GetNamespace()+"/"+obj.GetName()] = true
+	}
+	var generated []runtime.Object
+	for _, workload := range workloads {
+		var namespace, name, kind string
+		var podSpec corev1.PodSpec
+		switch w := workload.(type) {
+		case *appsv1.Deployment:
+			namespace, name, kind, podSpec = w.Namespace, w.Name, "Deployment", w.Spec.Template.Spec
+		case *appsv1.StatefulSet:
+			namespace, name, kind, podSpec = w.Namespace, w.Name, "StatefulSet", w.Spec.Template.Spec
+		default:
+			continue
+		}
+		if existing[namespace+"/"+name] {
+			continue
+		}
+		var applications []interface{}
+		for _, container := range podSpec.Containers {
+			if application, ok := detectApplication(container.Image); ok {
+				applications = append(applications, Application(container.Name, application))
+			}
+		}
+		generated = append(generated, InstrumentedApplication(namespace, name, kind, nil, applications))
+	}
+	return generated
+}
+
+// detectApplication returns the application of a container image, e.g. mongo:3.6 -> mongodb
+func detectApplication(image string) (string, bool) {
+	imageName := image[strings.LastIndex(image, "/")+1:]
+	if tag := strings.IndexAny(imageName, ":@"); tag >= 0 {
+		imageName = imageName[:tag]
+	}
+	for prefix, application := range knownApplications {
+		if strings.HasPrefix(imageName, prefix) {
+			return application, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,40 @@
+package simulator
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"testing"
+)
+
+func TestLoadFixtures(t *testing.T) {
+	workloads, crds, err := LoadFixtures("../../test/demoServices.yaml", "../../test/demoInstrumentedApplications.yaml")
+	require.NoError(t, err)
+	assert.Len(t, workloads, 26)
+	assert.Len(t, crds, 12)
+
+	generated := GenerateInstrumentedApplications(workloads, crds)
+	assert.Len(t, generated, len(workloads)-len(crds))
+	applications := map[string]interface{}{}
+	for _, obj := range generated {
+		crd := obj.(*unstructured.Unstructured)
+		assert.Equal(t, "sock-shop", crd.GetNamespace())
+		if apps, ok := crd.Object["spec"].(map[string]interface{})["applications"].([]interface{}); ok {
+			applications[crd.GetName()] = apps[0].(map[string]interface{})["application"]
+		}
+	}
+	assert.Equal(t, map[string]interface{}{
+		"carts-db":   "mongodb",
+		"orders-db":  "mongodb",
+		"rabbitmq":   "rabbitmq",
+		"session-db": "redis",
+	}, applications)
+
+	// workloads without a namespace are placed in the default namespace
+	for _, workload := range workloads {
+		if deployment, ok := workload.(*appsv1.Deployment); ok && deployment.Name == "loadgenerator" {
+			assert.Equal(t, defaultNamespace, deployment.Namespace)
+		}
+	}
+}
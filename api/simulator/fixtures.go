@@ -0,0 +1,129 @@
+package simulator
+
+import (
+	"github.com/logzio/easy-connect-server/api"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"strconv"
+	"sync/atomic"
+)
+
+const DetectionPhaseCompleted = "Completed"
+
+// NewDynamicClient creates a fake dynamic client that serves InstrumentedApplication resources.
+// Like the API server, it sets a new resourceVersion on every created or updated resource.
+func NewDynamicClient(objects ...runtime.Object) dynamic.Interface {
+	listKinds := map[schema.GroupVersionResource]string{
+		api.InstrumentedApplicationGVR: "InstrumentedApplicationList",
+	}
+	var resourceVersion int64
+	for _, obj := range objects {
+		if meta, ok := obj.(v1.Object); ok && meta.GetResourceVersion() == "" {
+			meta.SetResourceVersion(strconv.FormatInt(atomic.AddInt64(&resourceVersion, 1), 10))
+		}
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+	setResourceVersion := func(action k8stesting.Action) (bool, runtime.Object, error) {
+		var obj runtime.Object
+		switch action := action.(type) {
+		case k8stesting.CreateAction:
+			obj = action.GetObject()
+		case k8stesting.UpdateAction:
+			obj = action.GetObject()
+		}
+		if meta, ok := obj.(v1.Object); ok {
+			meta.SetResourceVersion(strconv.FormatInt(atomic.AddInt64(&resourceVersion, 1), 10))
+		}
+		// let the default reactor store the object
+		return false, nil, nil
+	}
+	client.PrependReactor("create", "*", setResourceVersion)
+	client.PrependReactor("update", "*", setResourceVersion)
+	return client
+}
+
+// InstrumentedApplication builds the InstrumentedApplication of a workload as created by the instrumentor after the detection completed.
+// ownerKind is the kind of the workload, e.g. Deployment. languages and applications are omitted from the spec if they are empty.
+func InstrumentedApplication(namespace, name, ownerKind string, languages []interface{}, applications []interface{}) *unstructured.Unstructured {
+	spec := map[string]interface{}{
+		"logType": "",
+	}
+	if len(languages) > 0 {
+		spec["languages"] = languages
+	}
+	if len(applications) > 0 {
+		spec["applications"] = applications
+	}
+	crd := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": spec,
+		"status": map[string]interface{}{
+			"tracesInstrumented": false,
+			"instrumentationDetection": map[string]interface{}{
+				"phase": DetectionPhaseCompleted,
+			},
+		},
+	}}
+	crd.SetAPIVersion(api.ResourceGroup + "/" + api.ResourceVersion)
+	crd.SetKind("InstrumentedApplication")
+	crd.SetNamespace(namespace)
+	crd.SetName(name)
+	crd.SetOwnerReferences([]v1.OwnerReference{{APIVersion: "apps/v1", Kind: ownerKind, Name: name}})
+	return crd
+}
+
+// Language builds a languages entry of an InstrumentedApplication spec
+func Language(containerName, language string) map[string]interface{} {
+	return map[string]interface{}{
+		"containerName":              containerName,
+		"language":                   language,
+		"activeServiceName":          "",
+		"opentelemetryPreconfigured": false,
+	}
+}
+
+// Application builds an applications entry of an InstrumentedApplication spec
+func Application(containerName, application string) map[string]interface{} {
+	return map[string]interface{}{
+		"containerName": containerName,
+		"application":   application,
+	}
+}
+
+// Deployment builds a deployment with one container per name
+func Deployment(namespace, name string, containerNames ...string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Namespace: namespace, Name: name, Generation: 1},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &v1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+			Template: podTemplate(name, containerNames),
+		},
+	}
+}
+
+// StatefulSet builds a statefulset with one container per name
+func StatefulSet(namespace, name string, containerNames ...string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: v1.ObjectMeta{Namespace: namespace, Name: name, Generation: 1},
+		Spec: appsv1.StatefulSetSpec{
+			Selector: &v1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+			Template: podTemplate(name, containerNames),
+		},
+	}
+}
+
+func podTemplate(name string, containerNames []string) corev1.PodTemplateSpec {
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: v1.ObjectMeta{Labels: map[string]string{"app": name}},
+	}
+	for _, containerName := range containerNames {
+		template.Spec.Containers = append(template.Spec.Containers, corev1.Container{Name: containerName})
+	}
+	return template
+}
@@ -0,0 +1,152 @@
+package simulator
+
+import (
+	"context"
+	"github.com/logzio/easy-connect-server/api"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"time"
+)
+
+// Instrumentor simulates the kubernetes-instrumentor.
+// It watches the pod template annotations of deployments and statefulsets and reflects them in the matching
+// InstrumentedApplication resources, first in the spec (log type, service name) and then in the status (traces instrumented).
+type Instrumentor struct {
+	clientset     kubernetes.Interface
+	dynamicClient dynamic.Interface
+	logger        *zap.SugaredLogger
+	delay         time.Duration
+}
+
+// NewInstrumentor creates an Instrumentor that watches workloads with clientset and updates custom resources with dynamicClient.
+// Every update of a custom resource is delayed by delay, to mimic the time the instrumentor takes in a cluster.
+func NewInstrumentor(clientset kubernetes.Interface, dynamicClient dynamic.Interface, logger *zap.SugaredLogger, delay time.Duration) *Instrumentor {
+	return &Instrumentor{
+		clientset:     clientset,
+		dynamicClient: dynamicClient,
+		logger:        logger,
+		delay:         delay,
+	}
+}
+
+// Start watches the workloads until the context is done, it returns once the watch caches are synced
+func (i *Instrumentor) Start(ctx context.Context) {
+	factory := informers.NewSharedInformerFactory(i.clientset, 0)
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			i.onWorkload(ctx, obj)
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			i.onWorkload(ctx, newObj)
+		},
+	}
+	factory.Apps().V1().Deployments().Informer().AddEventHandler(handler)
+	factory.Apps().V1().StatefulSets().Informer().AddEventHandler(handler)
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+}
+
+func (i *Instrumentor) onWorkload(ctx context.Context, obj interface{}) {
+	var namespace, name string
+	var annotations map[string]string
+	switch workload := obj.(type) {
+	case *appsv1.Deployment:
+		namespace, name, annotations = workload.Namespace, workload.Name, workload.Spec.Template.Annotations
+	case *appsv1.StatefulSet:
+		namespace, name, annotations = workload.Namespace, workload.Name, workload.Spec.Template.Annotations
+	default:
+		return
+	}
+	if err := i.Reconcile(ctx, namespace, name, annotations); err != nil {
+		i.logger.Warnw("Error while reconciling instrumented application", "namespace", namespace, "name", name, "error", err)
+	}
+}
+
+// Reconcile updates the InstrumentedApplication of a workload according to its pod template annotations.
+// Like the instrumentor, the log type, the service names and the instrumentation status are updated one at a time, and the
+// instrumentation only changes if logz.io/traces_instrument is true or rollback: without the annotation the agent stays as it is.
+func (i *Instrumentor) Reconcile(ctx context.Context, namespace, name string, annotations map[string]string) error {
+	client := i.dynamicClient.Resource(api.InstrumentedApplicationGVR).Namespace(namespace)
+	crd, err := client.Get(ctx, name, v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// spec: log type
+	crd, err = i.updateField(ctx, crd, "spec", func(spec map[string]interface{}) {
+		spec["logType"] = annotations[api.LogTypeAnnotation]
+	})
+	if err != nil {
+		return err
+	}
+	instrument := annotations[api.InstrumentationAnnotation] == api.InstrumentValue
+	if !instrument && annotations[api.InstrumentationAnnotation] != api.RollbackValue {
+		return nil
+	}
+	// spec: the active service name of every instrumentable container
+	crd, err = i.updateField(ctx, crd, "spec", func(spec map[string]interface{}) {
+		languages, _ := spec["languages"].([]interface{})
+		for _, language := range languages {
+			serviceName := ""
+			if instrument {
+				serviceName = annotations[api.ServiceNameAnnotation]
+			}
+			if language, ok := language.(map[string]interface{}); ok {
+				language["activeServiceName"] = serviceName
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// status: only containers with a detected language can be instrumented
+	_, err = i.updateField(ctx, crd, "status", func(status map[string]interface{}) {
+		spec, _ := crd.Object["spec"].(map[string]interface{})
+		_, hasLanguages := spec["languages"].([]interface{})
+		status["tracesInstrumented"] = instrument && hasLanguages
+	})
+	return err
+}
+
+// updateField applies mutate to a copy of the spec or status of the custom resource and updates it if anything changed
+func (i *Instrumentor) updateField(ctx context.Context, crd *unstructured.Unstructured, field string, mutate func(map[string]interface{})) (*unstructured.Unstructured, error) {
+	current, _ := crd.Object[field].(map[string]interface{})
+	updated := deepCopy(current)
+	mutate(updated)
+	if reflect.DeepEqual(current, updated) {
+		return crd, nil
+	}
+	if i.delay > 0 {
+		select {
+		case <-time.After(i.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	crd = crd.DeepCopy()
+	crd.Object[field] = updated
+	client := i.dynamicClient.Resource(api.InstrumentedApplicationGVR).Namespace(crd.GetNamespace())
+	if field == "status" {
+		return client.UpdateStatus(ctx, crd, v1.UpdateOptions{})
+	}
+	return client.Update(ctx, crd, v1.UpdateOptions{})
+}
+
+// deepCopy copies a custom resource field so changes can be compared with the original
+func deepCopy(field map[string]interface{}) map[string]interface{} {
+	if field == nil {
+		return map[string]interface{}{}
+	}
+	return runtime.DeepCopyJSON(field)
+}
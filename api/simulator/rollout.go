@@ -0,0 +1,299 @@
+package simulator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/logzio/easy-connect-server/api"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"strconv"
+	"time"
+)
+
+// NewClientset creates a fake clientset holding the given workloads.
+// Like the API server, it increments the generation of a deployment or statefulset when its spec changes.
+func NewClientset(objects ...runtime.Object) *fake.Clientset {
+	for _, obj := range objects {
+		if meta, ok := obj.(v1.Object); ok && meta.GetGeneration() == 0 {
+			meta.SetGeneration(1)
+		}
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+	tracker := clientset.Tracker()
+	bumpGeneration := func(action k8stesting.Action) (bool, runtime.Object, error) {
+		update, ok := action.(k8stesting.UpdateAction)
+		if !ok || update.GetSubresource() != "" {
+			return false, nil, nil
+		}
+		switch updated := update.GetObject().(type) {
+		case *appsv1.Deployment:
+			if existing, err := tracker.Get(action.GetResource(), updated.Namespace, updated.Name); err == nil {
+				existing := existing.(*appsv1.Deployment)
+				updated.Generation = existing.Generation
+				if !apiequality.Semantic.DeepEqual(existing.Spec, updated.Spec) {
+					updated.Generation++
+				}
+			}
+		case *appsv1.StatefulSet:
+			if existing, err := tracker.Get(action.GetResource(), updated.Namespace, updated.Name); err == nil {
+				existing := existing.(*appsv1.StatefulSet)
+				updated.Generation = existing.Generation
+				if !apiequality.Semantic.DeepEqual(existing.Spec, updated.Spec) {
+					updated.Generation++
+				}
+			}
+		}
+		// let the default reactor store the object
+		return false, nil, nil
+	}
+	clientset.PrependReactor("update", "deployments", bumpGeneration)
+	clientset.PrependReactor("update", "statefulsets", bumpGeneration)
+	return clientset
+}
+
+// CrashWhenInstrumentedAnnotation marks a workload whose pods crash loop when traces are instrumented, to try automatic rollbacks.
+// It is set on the metadata of the workload, not on its pod template.
+const CrashWhenInstrumentedAnnotation = "demo.logz.io/crash-when-instrumented"
+
+// DeploymentRevisionAnnotation is the annotation the deployment controller sets on the ReplicaSets of a deployment
+const DeploymentRevisionAnnotation = "deployment.kubernetes.io/revision"
+
+// RolloutController simulates the deployment and statefulset controllers.
+// When the generation of a workload changes, it replaces the workload's pods with ready pods of the new pod template and
+// reports the rollout as complete in the workload status. Every generation is recorded as a ReplicaSet or ControllerRevision.
+// Pods of workloads marked with CrashWhenInstrumentedAnnotation crash loop instead while traces are instrumented,
+// and the rollout never completes.
+type RolloutController struct {
+	clientset kubernetes.Interface
+	logger    *zap.SugaredLogger
+	delay     time.Duration
+}
+
+// NewRolloutController creates a RolloutController for the workloads of clientset, rollouts complete after delay
+func NewRolloutController(clientset kubernetes.Interface, logger *zap.SugaredLogger, delay time.Duration) *RolloutController {
+	return &RolloutController{
+		clientset: clientset,
+		logger:    logger,
+		delay:     delay,
+	}
+}
+
+// Start watches the workloads until the context is done, it returns once the watch caches are synced
+func (c *RolloutController) Start(ctx context.Context) {
+	factory := informers.NewSharedInformerFactory(c.clientset, 0)
+	reconcile := func(obj interface{}) {
+		if err := c.reconcile(ctx, obj); err != nil {
+			c.logger.Warnw("Error while simulating a rollout", "error", err)
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: reconcile,
+		UpdateFunc: func(_, newObj interface{}) {
+			reconcile(newObj)
+		},
+	}
+	factory.Apps().V1().Deployments().Informer().AddEventHandler(handler)
+	factory.Apps().V1().StatefulSets().Informer().AddEventHandler(handler)
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+}
+
+func (c *RolloutController) reconcile(ctx context.Context, obj interface{}) error {
+	switch workload := obj.(type) {
+	case *appsv1.Deployment:
+		if workload.Status.ObservedGeneration >= workload.Generation {
+			return nil
+		}
+		replicas, ready, err := c.rollout(ctx, workload.ObjectMeta, workload.Spec.Replicas, workload.Spec.Template)
+		if err != nil {
+			return err
+		}
+		workload = workload.DeepCopy()
+		workload.Status = appsv1.DeploymentStatus{
+			ObservedGeneration: workload.Generation,
+			Replicas:           replicas,
+			UpdatedReplicas:    replicas,
+			ReadyReplicas:      ready,
+			AvailableReplicas:  ready,
+		}
+		if err = c.recordReplicaSet(ctx, workload); err != nil {
+			return err
+		}
+		_, err = c.clientset.AppsV1().Deployments(workload.Namespace).UpdateStatus(ctx, workload, v1.UpdateOptions{})
+		return err
+	case *appsv1.StatefulSet:
+		if workload.Status.ObservedGeneration >= workload.Generation {
+			return nil
+		}
+		replicas, ready, err := c.rollout(ctx, workload.ObjectMeta, workload.Spec.Replicas, workload.Spec.Template)
+		if err != nil {
+			return err
+		}
+		revision := revisionName(workload.Name, workload.Generation)
+		workload = workload.DeepCopy()
+		workload.Status = appsv1.StatefulSetStatus{
+			ObservedGeneration: workload.Generation,
+			Replicas:           replicas,
+			UpdatedReplicas:    replicas,
+			ReadyReplicas:      ready,
+			AvailableReplicas:  ready,
+			CurrentReplicas:    replicas,
+			CurrentRevision:    revision,
+			UpdateRevision:     revision,
+		}
+		if err = c.recordControllerRevision(ctx, workload); err != nil {
+			return err
+		}
+		_, err = c.clientset.AppsV1().StatefulSets(workload.Namespace).UpdateStatus(ctx, workload, v1.UpdateOptions{})
+		return err
+	}
+	return nil
+}
+
+// rollout replaces the pods of a workload with pods of template after the delay, it returns the number of pods and of ready pods
+func (c *RolloutController) rollout(ctx context.Context, workload v1.ObjectMeta, replicas *int32, template corev1.PodTemplateSpec) (int32, int32, error) {
+	if c.delay > 0 {
+		select {
+		case <-time.After(c.delay):
+		case <-ctx.Done():
+			return 0, 0, ctx.Err()
+		}
+	}
+	count := int32(1)
+	if replicas != nil {
+		count = *replicas
+	}
+	crash := workload.Annotations[CrashWhenInstrumentedAnnotation] == "true" && template.Annotations[api.InstrumentationAnnotation] == api.InstrumentValue
+	pods := c.clientset.CoreV1().Pods(workload.Namespace)
+	existing, err := pods.List(ctx, v1.ListOptions{LabelSelector: labels.SelectorFromSet(template.Labels).String()})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, pod := range existing.Items {
+		if err = pods.Delete(ctx, pod.Name, v1.DeleteOptions{}); err != nil {
+			return 0, 0, err
+		}
+	}
+	for i := int32(0); i < count; i++ {
+		pod := Pod(workload.Namespace, fmt.Sprintf("%s-%d-%d", workload.Name, workload.Generation, i), template)
+		if crash {
+			pod = CrashLoopingPod(pod)
+		}
+		if _, err = pods.Create(ctx, pod, v1.CreateOptions{}); err != nil {
+			return 0, 0, err
+		}
+	}
+	c.logger.Infow("Simulated rollout", "namespace", workload.Namespace, "name", workload.Name, "generation", workload.Generation, "replicas", count, "crash", crash)
+	if crash {
+		return count, 0, nil
+	}
+	return count, count, nil
+}
+
+// recordReplicaSet creates the ReplicaSet of the deployment's generation, which the deployment controller keeps as revision history
+func (c *RolloutController) recordReplicaSet(ctx context.Context, deployment *appsv1.Deployment) error {
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: revisionMeta(deployment.ObjectMeta, "Deployment", deployment.Spec.Template.Labels),
+		Spec: appsv1.ReplicaSetSpec{
+			Replicas: deployment.Spec.Replicas,
+			Selector: deployment.Spec.Selector,
+			Template: deployment.Spec.Template,
+		},
+	}
+	replicaSet.Annotations = map[string]string{DeploymentRevisionAnnotation: strconv.FormatInt(deployment.Generation, 10)}
+	_, err := c.clientset.AppsV1().ReplicaSets(deployment.Namespace).Create(ctx, replicaSet, v1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		// the generation was rolled out before its status was overwritten
+		return nil
+	}
+	return err
+}
+
+// recordControllerRevision creates the ControllerRevision of the statefulset's generation, its data is a patch holding the pod template
+func (c *RolloutController) recordControllerRevision(ctx context.Context, statefulSet *appsv1.StatefulSet) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{"template": statefulSet.Spec.Template},
+	})
+	if err != nil {
+		return err
+	}
+	controllerRevision := &appsv1.ControllerRevision{
+		ObjectMeta: revisionMeta(statefulSet.ObjectMeta, "StatefulSet", statefulSet.Spec.Template.Labels),
+		Data:       runtime.RawExtension{Raw: data},
+		Revision:   statefulSet.Generation,
+	}
+	_, err = c.clientset.AppsV1().ControllerRevisions(statefulSet.Namespace).Create(ctx, controllerRevision, v1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// revisionMeta returns the metadata of the revision of a workload's generation, owned by the workload
+func revisionMeta(workload v1.ObjectMeta, kind string, labels map[string]string) v1.ObjectMeta {
+	return v1.ObjectMeta{
+		Namespace:         workload.Namespace,
+		Name:              revisionName(workload.Name, workload.Generation),
+		Labels:            labels,
+		CreationTimestamp: v1.Now(),
+		OwnerReferences: []v1.OwnerReference{{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       kind,
+			Name:       workload.Name,
+			UID:        workload.UID,
+		}},
+	}
+}
+
+// Pod builds a running and ready pod from a pod template
+func Pod(namespace, name string, template corev1.PodTemplateSpec) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: *template.ObjectMeta.DeepCopy(),
+		Spec:       *template.Spec.DeepCopy(),
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+	pod.Namespace, pod.Name = namespace, name
+	for _, container := range template.Spec.Containers {
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, corev1.ContainerStatus{
+			Name:  container.Name,
+			Ready: true,
+			State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+		})
+	}
+	return pod
+}
+
+// revisionName names the revision of a workload generation, like the statefulset controller revisions
+func revisionName(name string, generation int64) string {
+	return fmt.Sprintf("%s-rev%d", name, generation)
+}
+
+// CrashLoopingPod turns a pod into a pod whose containers crash loop
+func CrashLoopingPod(pod *corev1.Pod) *corev1.Pod {
+	pod = pod.DeepCopy()
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionFalse, Reason: "ContainersNotReady"}}
+	for i := range pod.Status.ContainerStatuses {
+		pod.Status.ContainerStatuses[i] = corev1.ContainerStatus{
+			Name:                 pod.Status.ContainerStatuses[i].Name,
+			RestartCount:         5,
+			State:                corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff", Message: "back-off restarting failed container"}},
+			LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Error", ExitCode: 1}},
+		}
+	}
+	return pod
+}
@@ -0,0 +1,42 @@
+package simulator
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"time"
+)
+
+func TestRolloutController(t *testing.T) {
+	clientset := NewClientset(Deployment(defaultNamespace, "adservice", "server"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	NewRolloutController(clientset, zap.NewNop().Sugar(), 0).Start(ctx)
+	deployments := clientset.AppsV1().Deployments(defaultNamespace)
+
+	deployment, err := deployments.Get(ctx, "adservice", v1.GetOptions{})
+	require.NoError(t, err)
+	deployment.Labels = map[string]string{"team": "ads"}
+	deployment, err = deployments.Update(ctx, deployment, v1.UpdateOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deployment.Generation, "metadata changes don't change the generation")
+
+	deployment.Spec.Template.Annotations = map[string]string{"logz.io/application_type": "java"}
+	deployment, err = deployments.Update(ctx, deployment, v1.UpdateOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deployment.Generation)
+
+	require.Eventually(t, func() bool {
+		deployment, err = deployments.Get(ctx, "adservice", v1.GetOptions{})
+		return err == nil && deployment.Status.ObservedGeneration == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), deployment.Status.AvailableReplicas)
+	pods, err := clientset.CoreV1().Pods(defaultNamespace).List(ctx, v1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, pods.Items, 1, "the pod of the first generation is replaced")
+	assert.Equal(t, "adservice-2-0", pods.Items[0].Name)
+	assert.Equal(t, "java", pods.Items[0].Annotations["logz.io/application_type"])
+}
@@ -1,13 +1,12 @@
 package state
 
 import (
-	"context"
 	"encoding/json"
 	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/logtypes"
 	"go.uber.org/zap"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/client-go/dynamic"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"net/http"
 	"strings"
 )
@@ -24,6 +23,9 @@ import (
 // language: the language of the application that the container belongs to
 // detection_status: the status of the detection process
 // log_type: the log type of the application that the container belongs to
+// resource_version: the resourceVersion of the custom resource, it can be sent as expected.resource_version to /api/v1/annotate
+// suggested_log_type: the log type recommended for the detected application or language of the container, null if there is none
+// unknown_log_type: whether the log type is set and isn't in the log type catalog
 type InstrumentdApplicationData struct {
 	Name                       string  `json:"name"`
 	Namespace                  string  `json:"namespace"`
@@ -37,116 +39,49 @@ type InstrumentdApplicationData struct {
 	DetectionStatus            string  `json:"detection_status"`
 	OpentelemetryPreconfigured *bool   `json:"opentelemetry_preconfigured"`
 	LogType                    *string `json:"log_type"`
+	ResourceVersion            string  `json:"resource_version"`
+	SuggestedLogType           *string `json:"suggested_log_type"`
+	UnknownLogType             bool    `json:"unknown_log_type"`
+}
+
+// Handler serves the state endpoint
+type Handler struct {
+	app      *api.App
+	logTypes *logtypes.Catalog
+}
+
+// NewHandler creates a state Handler that uses the app's clients
+func NewHandler(app *api.App) *Handler {
+	return &Handler{app: app, logTypes: logtypes.FromApp(app)}
 }
 
 // GetCustomResourcesHandler lists all custom resources of type InstrumentedApplication
-func GetCustomResourcesHandler(w http.ResponseWriter, r *http.Request) {
-	logger := api.InitLogger()
-	defer logger.Sync()
+func (h *Handler) GetCustomResourcesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := h.app.Logger
 	if r.Method != http.MethodGet {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		api.WriteError(w, r, api.NewError(http.StatusMethodNotAllowed, api.CodeMethodNotAllowed, "Invalid request method"))
 		return
 	}
-	config, err := api.GetConfig()
-	if err != nil {
-		logger.Error(api.ErrorKubeConfig, zap.Error(err))
-		http.Error(w, api.ErrorKubeConfig+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	// Create a dynamic client
-	dynamicClient, err := dynamic.NewForConfig(config)
-	if err != nil {
-		logger.Error(api.ErrorDynamic, zap.Error(err))
-		http.Error(w, api.ErrorDynamic+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	gvr := schema.GroupVersionResource{
-		Group:    api.ResourceGroup,
-		Version:  api.ResourceVersion,
-		Resource: api.ResourceInstrumentedApplication,
-	}
 	// List all custom resources
-	instrumentedApplicationsList, err := dynamicClient.Resource(gvr).Namespace("").List(context.Background(), v1.ListOptions{})
+	instrumentedApplicationsList, err := h.app.DynamicClient.Resource(api.InstrumentedApplicationGVR).Namespace("").List(r.Context(), v1.ListOptions{})
 	if err != nil {
+		if api.RequestCancelled(r, logger, "list instrumented applications") {
+			return
+		}
 		logger.Error(api.ErrorList, zap.Error(err))
-		http.Error(w, api.ErrorList+err.Error(), http.StatusInternalServerError)
+		api.WriteError(w, r, api.FromKubernetesError(api.ErrorList, err))
 		return
 	}
-	// Build a list of InstrumentdApplicationData from the custom resources
+	// Build a list of InstrumentdApplicationData from the custom resources, flagging the log types that aren't in the catalog
+	logTypes := h.logTypes.Names(r.Context())
 	var data []InstrumentdApplicationData
 	for _, item := range instrumentedApplicationsList.Items {
-		name := item.GetName()
 		// Skip internal resources
-		if api.IsInternalResource(name) {
+		if api.IsInternalResource(item.GetName()) {
 			continue
 		}
-		namespace := item.GetNamespace()
-		controllerKind := strings.ToLower(item.GetOwnerReferences()[0].Kind)
-		status := item.Object["status"].(map[string]interface{})
-		spec := item.Object["spec"].(map[string]interface{})
-		logType := spec["logType"].(string)
-		// Check if the languages field is present in the spec
-		languages, langOk := spec["languages"].([]interface{})
-		if langOk {
-			// Handle the languages field
-			for _, language := range languages {
-				langStr := language.(map[string]interface{})["language"].(string)
-				containerNameStr := language.(map[string]interface{})["containerName"].(string)
-				// Handle the serviceName field, since this app can be instrumented
-				serviceName := calculateServiceName(language)
-				otelDetectedBool := language.(map[string]interface{})["opentelemetryPreconfigured"].(bool)
-				entry := InstrumentdApplicationData{
-					Name:                       name,
-					Namespace:                  namespace,
-					ControllerKind:             controllerKind,
-					TracesInstrumented:         status["tracesInstrumented"].(bool),
-					TracesInstrumentable:       true,
-					ServiceName:                &serviceName,
-					ContainerName:              &containerNameStr,
-					Language:                   &langStr,
-					DetectionStatus:            status["instrumentationDetection"].(map[string]interface{})["phase"].(string),
-					LogType:                    &logType,
-					OpentelemetryPreconfigured: &otelDetectedBool,
-				}
-				data = append(data, entry)
-			}
-		}
-		// Check if the applications field is present in the spec
-		applications, appOk := spec["applications"].([]interface{})
-		// Handle the applications field
-		if appOk {
-			for _, application := range applications {
-				applicationStr := application.(map[string]interface{})["application"].(string)
-				containerNameStr := application.(map[string]interface{})["containerName"].(string)
-				otelDetectedBool := false
-				entry := InstrumentdApplicationData{
-					Name:                       name,
-					Namespace:                  namespace,
-					ControllerKind:             controllerKind,
-					TracesInstrumented:         status["tracesInstrumented"].(bool),
-					TracesInstrumentable:       false,
-					ContainerName:              &containerNameStr,
-					Application:                &applicationStr,
-					DetectionStatus:            status["instrumentationDetection"].(map[string]interface{})["phase"].(string),
-					LogType:                    &logType,
-					OpentelemetryPreconfigured: &otelDetectedBool,
-				}
-				data = append(data, entry)
-			}
-		}
-		// Handle the case where the languages and applications fields are not present in the spec
-		if !langOk && !appOk {
-			otelDetectedBool := false
-			entry := InstrumentdApplicationData{
-				Name:                       name,
-				Namespace:                  namespace,
-				ControllerKind:             controllerKind,
-				TracesInstrumented:         status["tracesInstrumented"].(bool),
-				TracesInstrumentable:       false,
-				DetectionStatus:            status["instrumentationDetection"].(map[string]interface{})["phase"].(string),
-				LogType:                    &logType,
-				OpentelemetryPreconfigured: &otelDetectedBool,
-			}
+		for _, entry := range FromInstrumentedApplication(&item) {
+			entry.UnknownLogType = entry.LogType != nil && *entry.LogType != "" && !logTypes[*entry.LogType]
 			data = append(data, entry)
 		}
 	}
@@ -155,9 +90,99 @@ func GetCustomResourcesHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(data)
 }
 
-func calculateServiceName(service interface{}) string {
-	if service.(map[string]interface{})["activeServiceName"] == nil {
-		return ""
+// FromInstrumentedApplication returns the data of every container of an InstrumentedApplication,
+// or a single entry without a container if neither languages nor applications were detected.
+// Missing or malformed fields are left empty, the instrumentor may not have filled them yet.
+func FromInstrumentedApplication(item *unstructured.Unstructured) []InstrumentdApplicationData {
+	var data []InstrumentdApplicationData
+	controllerKind := ""
+	if owners := item.GetOwnerReferences(); len(owners) > 0 {
+		controllerKind = strings.ToLower(owners[0].Kind)
+	}
+	status, _ := item.Object["status"].(map[string]interface{})
+	spec, _ := item.Object["spec"].(map[string]interface{})
+	logType, _ := spec["logType"].(string)
+	tracesInstrumented, _ := status["tracesInstrumented"].(bool)
+	detection, _ := status["instrumentationDetection"].(map[string]interface{})
+	detectionStatus, _ := detection["phase"].(string)
+	// newEntry returns the fields shared by the entries of the custom resource
+	newEntry := func() InstrumentdApplicationData {
+		otelDetectedBool := false
+		return InstrumentdApplicationData{
+			Name:                       item.GetName(),
+			Namespace:                  item.GetNamespace(),
+			ControllerKind:             controllerKind,
+			TracesInstrumented:         tracesInstrumented,
+			DetectionStatus:            detectionStatus,
+			LogType:                    &logType,
+			OpentelemetryPreconfigured: &otelDetectedBool,
+			ResourceVersion:            item.GetResourceVersion(),
+		}
 	}
-	return service.(map[string]interface{})["activeServiceName"].(string)
+	// Check if the languages field is present in the spec
+	languages, langOk := spec["languages"].([]interface{})
+	if langOk {
+		// Handle the languages field
+		for _, language := range languages {
+			languageMap, _ := language.(map[string]interface{})
+			langStr, _ := languageMap["language"].(string)
+			containerNameStr, _ := languageMap["containerName"].(string)
+			// Handle the serviceName field, since this app can be instrumented
+			serviceName := calculateServiceName(languageMap)
+			otelDetectedBool, _ := languageMap["opentelemetryPreconfigured"].(bool)
+			entry := newEntry()
+			entry.TracesInstrumentable = true
+			entry.ServiceName = &serviceName
+			entry.ContainerName = &containerNameStr
+			entry.Language = &langStr
+			entry.SuggestedLogType = suggestLogType("", langStr)
+			entry.OpentelemetryPreconfigured = &otelDetectedBool
+			data = append(data, entry)
+		}
+	}
+	// Check if the applications field is present in the spec
+	applications, appOk := spec["applications"].([]interface{})
+	// Handle the applications field
+	if appOk {
+		for _, application := range applications {
+			applicationMap, _ := application.(map[string]interface{})
+			applicationStr, _ := applicationMap["application"].(string)
+			containerNameStr, _ := applicationMap["containerName"].(string)
+			entry := newEntry()
+			entry.ContainerName = &containerNameStr
+			entry.Application = &applicationStr
+			entry.SuggestedLogType = suggestLogType(applicationStr, "")
+			data = append(data, entry)
+		}
+	}
+	// Handle the case where the languages and applications fields are not present in the spec or empty
+	if len(data) == 0 {
+		data = append(data, newEntry())
+	}
+	return data
+}
+
+// ContainerData returns the data of a container of an InstrumentedApplication.
+// The entry without a container is returned if no languages or applications were detected, false if the container is unknown.
+func ContainerData(item *unstructured.Unstructured, containerName string) (InstrumentdApplicationData, bool) {
+	for _, entry := range FromInstrumentedApplication(item) {
+		if entry.ContainerName == nil || *entry.ContainerName == containerName {
+			return entry, true
+		}
+	}
+	return InstrumentdApplicationData{}, false
+}
+
+// suggestLogType returns the recommended log type of a detected application or language, nil if there is none
+func suggestLogType(application, language string) *string {
+	logType := logtypes.Suggest(application, language)
+	if logType == "" {
+		return nil
+	}
+	return &logType
+}
+
+func calculateServiceName(service map[string]interface{}) string {
+	serviceName, _ := service["activeServiceName"].(string)
+	return serviceName
 }
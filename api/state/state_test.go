@@ -0,0 +1,109 @@
+package state
+
+import (
+	"encoding/json"
+	"github.com/logzio/easy-connect-server/api"
+	"github.com/logzio/easy-connect-server/api/config"
+	"github.com/logzio/easy-connect-server/api/simulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+func TestGetCustomResourcesHandler(t *testing.T) {
+	instrumented := simulator.Language("server", "java")
+	instrumented["activeServiceName"] = "ads"
+	instrumentedCrd := simulator.InstrumentedApplication("default", "adservice", "Deployment", []interface{}{instrumented}, nil)
+	instrumentedCrd.Object["spec"].(map[string]interface{})["logType"] = "java"
+	instrumentedCrd.Object["status"].(map[string]interface{})["tracesInstrumented"] = true
+
+	redisCrd := simulator.InstrumentedApplication("default", "redis-cart", "StatefulSet", nil, []interface{}{simulator.Application("redis", "redis")})
+	redisCrd.Object["spec"].(map[string]interface{})["logType"] = "rdis"
+	loadgeneratorCrd := simulator.InstrumentedApplication("shop", "loadgenerator", "Deployment", nil, nil)
+	loadgeneratorCrd.Object["spec"].(map[string]interface{})["logType"] = "locust"
+	// the catalog ConfigMap adds locust to the built-in log types
+	catalog := &corev1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "easy-connect-log-types"},
+		Data:       map[string]string{"locust": "Locust load generator logs"},
+	}
+
+	dynamicClient := simulator.NewDynamicClient(
+		instrumentedCrd,
+		redisCrd,
+		loadgeneratorCrd,
+		// internal resources are not part of the state
+		simulator.InstrumentedApplication("monitoring", "easy-connect-server", "Deployment", []interface{}{simulator.Language("server", "go")}, nil),
+	)
+	app := api.NewAppWithClients(config.Default(), zap.NewNop().Sugar(), fake.NewSimpleClientset(catalog), dynamicClient)
+
+	recorder := httptest.NewRecorder()
+	NewHandler(app).GetCustomResourcesHandler(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/state", nil))
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	var data []InstrumentdApplicationData
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &data))
+	require.Len(t, data, 3)
+	sort.Slice(data, func(i, j int) bool { return data[i].Name < data[j].Name })
+
+	adservice := data[0]
+	assert.Equal(t, "adservice", adservice.Name)
+	assert.Equal(t, api.KindDeployment, adservice.ControllerKind)
+	assert.Equal(t, "server", *adservice.ContainerName)
+	assert.Equal(t, "java", *adservice.Language)
+	assert.Equal(t, "ads", *adservice.ServiceName)
+	assert.Equal(t, "java", *adservice.LogType)
+	assert.True(t, adservice.TracesInstrumented)
+	assert.True(t, adservice.TracesInstrumentable)
+	assert.Equal(t, simulator.DetectionPhaseCompleted, adservice.DetectionStatus)
+	assert.False(t, adservice.UnknownLogType)
+	assert.Equal(t, "java", *adservice.SuggestedLogType)
+
+	loadgenerator := data[1]
+	assert.Equal(t, "shop", loadgenerator.Namespace)
+	assert.Nil(t, loadgenerator.ContainerName)
+	assert.False(t, loadgenerator.TracesInstrumentable)
+	assert.False(t, loadgenerator.UnknownLogType, "the log type is in the ConfigMap")
+	assert.Nil(t, loadgenerator.SuggestedLogType, "nothing was detected")
+
+	redis := data[2]
+	assert.Equal(t, api.KindStatefulSet, redis.ControllerKind)
+	assert.Equal(t, "redis", *redis.Application)
+	assert.Equal(t, "redis", *redis.ContainerName)
+	assert.Nil(t, redis.Language)
+	assert.False(t, redis.TracesInstrumentable)
+	assert.True(t, redis.UnknownLogType)
+	assert.Equal(t, "redis", *redis.SuggestedLogType)
+}
+
+func TestFromInstrumentedApplicationPartial(t *testing.T) {
+	// a custom resource the instrumentor didn't fill yet: no owner, status or detection phase
+	crd := simulator.InstrumentedApplication("default", "adservice", "Deployment", []interface{}{map[string]interface{}{"containerName": "server"}}, nil)
+	crd.SetOwnerReferences(nil)
+	delete(crd.Object, "status")
+
+	data := FromInstrumentedApplication(crd)
+	require.Len(t, data, 1)
+	assert.Equal(t, "", data[0].ControllerKind)
+	assert.Equal(t, "", data[0].DetectionStatus)
+	assert.False(t, data[0].TracesInstrumented)
+	assert.Equal(t, "server", *data[0].ContainerName)
+	assert.Equal(t, "", *data[0].ServiceName)
+	assert.Equal(t, "", *data[0].Language)
+}
+
+func TestFromInstrumentedApplicationEmpty(t *testing.T) {
+	crd := simulator.InstrumentedApplication("default", "adservice", "Deployment", nil, nil)
+	crd.Object["spec"].(map[string]interface{})["languages"] = []interface{}{}
+
+	data := FromInstrumentedApplication(crd)
+	require.Len(t, data, 1, "empty lists are the same as missing ones")
+	assert.Equal(t, "adservice", data[0].Name)
+	assert.Nil(t, data[0].ContainerName)
+}
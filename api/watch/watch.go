@@ -0,0 +1,162 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"sync"
+)
+
+// Event is an update of a watched resource
+type Event struct {
+	Old *unstructured.Unstructured
+	New *unstructured.Unstructured
+}
+
+// Manager watches every resource of a kind with a single informer and dispatches its updates to the waiters registered for them.
+// Dispatching never blocks: events are queued on the waiter until it reads them or deregisters.
+type Manager struct {
+	logger   *zap.SugaredLogger
+	factory  dynamicinformer.DynamicSharedInformerFactory
+	informer cache.SharedIndexInformer
+
+	mu      sync.Mutex
+	waiters map[string]map[*Waiter]struct{}
+}
+
+// NewManager creates a Manager for the resources of gvr in all namespaces, it doesn't watch anything until Start is called
+func NewManager(dynamicClient dynamic.Interface, gvr schema.GroupVersionResource, logger *zap.SugaredLogger) *Manager {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	m := &Manager{
+		logger:   logger,
+		factory:  factory,
+		informer: factory.ForResource(gvr).Informer(),
+		waiters:  map[string]map[*Waiter]struct{}{},
+	}
+	m.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			o, oldOk := oldObj.(*unstructured.Unstructured)
+			n, newOk := newObj.(*unstructured.Unstructured)
+			if oldOk && newOk {
+				m.dispatch(Event{Old: o, New: n})
+			}
+		},
+	})
+	return m
+}
+
+// Start watches the resources until ctx is done, it returns once the initial list is synced
+func (m *Manager) Start(ctx context.Context) error {
+	m.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), m.informer.HasSynced) {
+		return fmt.Errorf("error syncing the watch cache: %w", ctx.Err())
+	}
+	return nil
+}
+
+// Get returns the latest version of a resource known to the watch
+func (m *Manager) Get(namespace, name string) (*unstructured.Unstructured, bool) {
+	obj, exists, err := m.informer.GetStore().GetByKey(key(namespace, name))
+	if err != nil || !exists {
+		return nil, false
+	}
+	return obj.(*unstructured.Unstructured), true
+}
+
+// Register returns a Waiter that receives the updates of a resource until it is deregistered
+func (m *Manager) Register(namespace, name string) *Waiter {
+	w := &Waiter{
+		manager: m,
+		key:     key(namespace, name),
+		notify:  make(chan struct{}, 1),
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.waiters[w.key] == nil {
+		m.waiters[w.key] = map[*Waiter]struct{}{}
+	}
+	m.waiters[w.key][w] = struct{}{}
+	return w
+}
+
+// Waiters returns the number of registered waiters
+func (m *Manager) Waiters() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := 0
+	for _, waiters := range m.waiters {
+		count += len(waiters)
+	}
+	return count
+}
+
+func (m *Manager) deregister(w *Waiter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.waiters[w.key], w)
+	if len(m.waiters[w.key]) == 0 {
+		delete(m.waiters, w.key)
+	}
+}
+
+func (m *Manager) dispatch(event Event) {
+	eventKey := key(event.New.GetNamespace(), event.New.GetName())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for w := range m.waiters[eventKey] {
+		w.push(event)
+	}
+	m.logger.Debugw("Dispatched watch event", "resource", eventKey, "waiters", len(m.waiters[eventKey]))
+}
+
+func key(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// Waiter receives the updates of a single resource
+type Waiter struct {
+	manager *Manager
+	key     string
+	notify  chan struct{}
+
+	mu      sync.Mutex
+	pending []Event
+	once    sync.Once
+}
+
+// Ready returns a channel that receives a value when events are pending
+func (w *Waiter) Ready() <-chan struct{} {
+	return w.notify
+}
+
+// Events returns and clears the pending events, oldest first
+func (w *Waiter) Events() []Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	events := w.pending
+	w.pending = nil
+	return events
+}
+
+// Deregister stops the delivery of events, it is safe to call more than once
+func (w *Waiter) Deregister() {
+	w.once.Do(func() {
+		w.manager.deregister(w)
+	})
+}
+
+func (w *Waiter) push(event Event) {
+	w.mu.Lock()
+	w.pending = append(w.pending, event)
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+		// a notification is already pending
+	}
+}
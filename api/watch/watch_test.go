@@ -0,0 +1,74 @@
+package watch
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"testing"
+	"time"
+)
+
+var testGVR = schema.GroupVersionResource{Group: "logz.io", Version: "v1alpha1", Resource: "instrumentedapplications"}
+
+func newResource(namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"logType": ""}}}
+	obj.SetAPIVersion("logz.io/v1alpha1")
+	obj.SetKind("InstrumentedApplication")
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func TestManager(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{testGVR: "InstrumentedApplicationList"},
+		newResource("default", "adservice"), newResource("default", "cartservice"))
+	manager := NewManager(client, testGVR, zap.NewNop().Sugar())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, manager.Start(ctx))
+
+	cached, ok := manager.Get("default", "adservice")
+	require.True(t, ok)
+	assert.Equal(t, "adservice", cached.GetName())
+
+	adservice := manager.Register("default", "adservice")
+	unread := manager.Register("default", "adservice")
+	assert.Equal(t, 2, manager.Waiters())
+
+	update := func(name, logType string) {
+		obj := newResource("default", name)
+		obj.Object["spec"].(map[string]interface{})["logType"] = logType
+		_, err := client.Resource(testGVR).Namespace("default").Update(ctx, obj, v1.UpdateOptions{})
+		require.NoError(t, err)
+	}
+	update("cartservice", "dotnet")
+	update("adservice", "java")
+	update("adservice", "java-v2")
+
+	var events []Event
+	for len(events) < 2 {
+		select {
+		case <-adservice.Ready():
+			events = append(events, adservice.Events()...)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for events")
+		}
+	}
+	require.Len(t, events, 2, "only the updates of the registered resource are delivered")
+	assert.Equal(t, "java", events[0].New.Object["spec"].(map[string]interface{})["logType"])
+	assert.Equal(t, "java-v2", events[1].New.Object["spec"].(map[string]interface{})["logType"])
+
+	// a waiter that never reads its events doesn't block the others and is removed once it deregisters
+	unread.Deregister()
+	unread.Deregister()
+	adservice.Deregister()
+	assert.Zero(t, manager.Waiters())
+	update("adservice", "log")
+}
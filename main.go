@@ -1,21 +1,153 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"expvar"
 	"github.com/gorilla/mux"
+	"github.com/logzio/easy-connect-server/api"
 	annotateapi "github.com/logzio/easy-connect-server/api/annotate"
+	"github.com/logzio/easy-connect-server/api/config"
+	historyapi "github.com/logzio/easy-connect-server/api/history"
+	"github.com/logzio/easy-connect-server/api/idempotency"
+	"github.com/logzio/easy-connect-server/api/logtypes"
+	"github.com/logzio/easy-connect-server/api/podlogs"
+	"github.com/logzio/easy-connect-server/api/simulator"
 	stateapi "github.com/logzio/easy-connect-server/api/state"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// drainTimeout is how long interrupted requests get to write their partial progress before connections are closed
+const drainTimeout = 5 * time.Second
+
 // main starts the server. Endpoints:
 // 1. /api/v1/state - returns a list of all custom resources of type InstrumentedApplication
-// 2. /api/v1/annotate - handles the POST request for annotating a supported resource kind
+// 2. /api/v1/annotate - handles the POST request for annotating a supported resource kind, and the PATCH request that only changes the fields it sets
+// 3. /api/v1/operations/{id}/revert - restores the annotations a workload had before an operation
+// 4. /api/v1/workloads/{namespace}/{kind}/{name}/history - returns the changes of a workload's logz.io annotations
+// 5. /api/v1/workloads/{namespace}/{kind}/{name}/containers/{container}/traces and /logs - set (PUT) or remove (DELETE) only the
+// traces instrumentation or only the log type of a container, GET .../logs returns the last lines the container logged
+// 6. /api/v1/service-names/validate - checks a service name against the other workloads of the cluster and suggests service names
+// 7. /api/v1/log-types - returns the log types annotate requests accept
+// 8. /api/v1/namespaces/{namespace}/suggested-log-types/apply - sets the log types suggested for the detected applications of a namespace
+// 9. /api/v1/workloads/{namespace}/{kind}/{name}/containers/{container}/log-type-suggestions - suggests log types for the
+// formats of the last lines a container logged
+// 10. /debug/vars - exposes the server's counters
 func main() {
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// appCtx stops the app's background watches once the server is stopped
+	appCtx, stopApp := context.WithCancel(context.Background())
+	defer stopApp()
+	var app *api.App
+	if cfg.Demo {
+		app, err = simulator.NewDemoApp(appCtx, cfg)
+	} else {
+		app, err = api.NewApp(cfg)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = app.Start(appCtx); err != nil {
+		log.Fatal(err)
+	}
+	defer app.Logger.Sync()
+	app.Logger.Infow("Effective configuration", "config", cfg)
+
+	var inFlight sync.WaitGroup
 	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/api/v1/state", stateapi.GetCustomResourcesHandler).Methods(http.MethodGet)
-	router.HandleFunc("/api/v1/annotate", annotateapi.UpdateResourceAnnotations).Methods(http.MethodPost)
-	fmt.Println("Starting server on :5050")
-	log.Fatal(http.ListenAndServe(":5050", router))
+	router.NotFoundHandler = api.NotFoundHandler()
+	router.MethodNotAllowedHandler = api.MethodNotAllowedHandler()
+	router.Use(trackInFlight(&inFlight), api.Recover(app.Logger))
+	router.HandleFunc("/api/v1/state", stateapi.NewHandler(app).GetCustomResourcesHandler).Methods(http.MethodGet)
+	annotateHandler := annotateapi.NewHandler(app)
+	idempotent := idempotency.NewStore(idempotency.DefaultTTL, idempotency.DefaultLimit, app.Logger)
+	router.HandleFunc("/api/v1/annotate", idempotent.Handle(annotateHandler.UpdateResourceAnnotations)).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/annotate", idempotent.Handle(annotateHandler.PatchResourceAnnotations)).Methods(http.MethodPatch)
+	router.HandleFunc("/api/v1/operations/{id}/revert", idempotent.Handle(annotateHandler.RevertOperation)).Methods(http.MethodPost)
+	containerPath := "/api/v1/workloads/{namespace}/{kind}/{name}/containers/{container}"
+	router.HandleFunc(containerPath+"/traces", idempotent.Handle(annotateHandler.PutTraces)).Methods(http.MethodPut)
+	router.HandleFunc(containerPath+"/traces", idempotent.Handle(annotateHandler.DeleteTraces)).Methods(http.MethodDelete)
+	router.HandleFunc(containerPath+"/logs", idempotent.Handle(annotateHandler.PutLogs)).Methods(http.MethodPut)
+	router.HandleFunc(containerPath+"/logs", idempotent.Handle(annotateHandler.DeleteLogs)).Methods(http.MethodDelete)
+	router.HandleFunc("/api/v1/log-types", logtypes.NewHandler(app).GetLogTypes).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/namespaces/{namespace}/suggested-log-types/apply", idempotent.Handle(annotateHandler.ApplySuggestedLogTypes)).Methods(http.MethodPost)
+	router.HandleFunc("/api/v1/service-names/validate", annotateHandler.ValidateServiceName).Methods(http.MethodPost)
+	podLogsHandler := podlogs.NewHandler(app)
+	router.HandleFunc(containerPath+"/logs", podLogsHandler.GetLogs).Methods(http.MethodGet)
+	router.HandleFunc(containerPath+"/log-type-suggestions", podLogsHandler.SuggestLogTypes).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/workloads/{namespace}/{kind}/{name}/history", historyapi.NewHandler(app).GetWorkloadHistory).Methods(http.MethodGet)
+	router.Handle("/debug/vars", expvar.Handler()).Methods(http.MethodGet)
+	server := &http.Server{
+		Addr:    cfg.ListenAddress,
+		Handler: api.CORS(cfg.CORSAllowedOrigins, api.RequestID(router)),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	serverErr := make(chan error, 1)
+	go func() {
+		app.Logger.Infow("Starting server", "address", cfg.ListenAddress)
+		serverErr <- server.ListenAndServe()
+	}()
+	select {
+	case err = <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			app.Logger.Fatalw("Error while serving", "error", err)
+		}
+		return
+	case <-ctx.Done():
+	}
+	stop()
+	shutdown(app, server, &inFlight)
+}
+
+// shutdown stops accepting new requests and waits up to the grace period for in-flight requests to complete.
+// Requests that are still waiting after the grace period are told to stop and report their partial progress.
+func shutdown(app *api.App, server *http.Server, inFlight *sync.WaitGroup) {
+	gracePeriod := app.ShutdownGracePeriod()
+	logger := app.Logger
+	logger.Infow("Shutting down server, waiting for in-flight requests", "grace_period", gracePeriod.String())
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err == nil {
+		logger.Info("Server stopped")
+		return
+	}
+	logger.Warnw("Grace period expired, interrupting in-flight requests", "error", err)
+	app.Shutdown()
+	drained := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		logger.Warn("Timed out while waiting for interrupted requests to respond")
+	}
+	if err = server.Close(); err != nil {
+		logger.Errorw("Error while closing server", "error", err)
+	}
+	logger.Info("Server stopped")
+}
+
+// trackInFlight counts the requests that are currently being served
+func trackInFlight(inFlight *sync.WaitGroup) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inFlight.Add(1)
+			defer inFlight.Done()
+			next.ServeHTTP(w, r)
+		})
+	}
 }
@@ -1,3 +1,7 @@
+//go:build integration
+
+// The api test runs against a live server on localhost:5050 connected to a cluster with test/demoServices.yaml deployed.
+// Run it with `make test-api`.
 package test
 
 import (
@@ -33,6 +37,7 @@ type AnnotateRequest struct {
 	LogType        string `json:"log_type"`
 	ContainerName  string `json:"container_name"`
 	ServiceName    string `json:"service_name"`
+	CustomLogType  bool   `json:"custom_log_type"`
 }
 type AnnotateResponse struct {
 	Name           string `json:"name"`
@@ -193,6 +198,8 @@ func TestApi(t *testing.T) {
 				}
 
 				annotate := tc.Modify(&state)
+				// the cases use the workload names as log types
+				annotate.CustomLogType = true
 
 				annotateReqBody, err := json.Marshal(annotate)
 				if err != nil {